@@ -21,87 +21,148 @@ func NewPulse(bpm float32) *Pulse {
 
 // Current beat time.
 func (p *Pulse) Now() Time {
-	return Time{beat: float32(time.Now().Sub(p.epoch).Minutes()) * p.bpm}
+	return p.At(time.Now())
+}
+
+// Beat time at the instant, or now if zero.
+func (p *Pulse) At(t time.Time) Time {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return Time{tick: int64(t.Sub(p.epoch).Minutes() * float64(p.bpm) * TicksPerBeat), valid: true}
+}
+
+func (p *Pulse) IsFrozen() bool {
+	return p.frozen.Valid()
 }
 
 func (p *Pulse) ToggleFrozen() {
-	if p.frozen.IsZero() {
+	if !p.frozen.Valid() {
 		p.frozen = p.Now()
 	} else {
 		p.frozen = Time{}
 	}
 }
 
+func (p *Pulse) SetFrozen(frozen bool) {
+	if frozen != p.IsFrozen() {
+		p.ToggleFrozen()
+	}
+}
+
 // Current (potentially frozen) time.
 func (p *Pulse) Horizon() Time {
-	if p.frozen.IsZero() {
+	if !p.frozen.Valid() {
 		return p.Now()
 	} else {
 		return p.frozen
 	}
 }
 
-// Update BPM and adjust epoch to the beat happening right this instant.
-func (p *Pulse) Sync(bpm float32) {
-	// Current logical beat
-	oldBeat := p.Now().Delta(Time{}).Beats()
-	// We want the beat to occur exactly now
-	wantBeat := float32(math.Round(float64(oldBeat)))
+// Update BPM and adjust epoch to the beat happening at the instant, or right
+// now if zero.
+func (p *Pulse) Sync(bpm float32, at time.Time) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	// Logical beat at the instant
+	oldBeat := p.At(at).Beat()
+	// We want the beat to occur exactly then
+	wantBeat := math.Round(float64(oldBeat))
 	// Adjust epoch such that with new BPM results in target number of beats
-	p.epoch = time.Now().Add(-time.Duration((wantBeat / bpm) * float32(time.Minute)))
+	p.epoch = at.Add(-time.Duration(wantBeat / float64(bpm) * float64(time.Minute)))
 	p.bpm = bpm
 }
 
+// Resolution of Time and Duration, enough to not lose precision over a long
+// session like float32 beats would.
+const TicksPerBeat = 960
+
+// Saturated to stand for forever.
+const foreverTicks = math.MaxInt64
+
 type Duration struct {
-	beats float32
+	ticks int64
 }
 
 func (d Duration) String() string {
-	return fmt.Sprintf("beats=%.2f", d.beats)
+	return fmt.Sprintf("beats=%.2f", d.Beats())
 }
 
+// Duration of the beats, saturated to Forever() if too long to count in ticks
+// and zero if not a number.
 func Beats(beats float32) Duration {
-	return Duration{beats: beats}
+	ticks := math.Round(float64(beats) * TicksPerBeat)
+	switch {
+	case math.IsNaN(ticks):
+		return Duration{}
+	case ticks >= foreverTicks:
+		return Forever()
+	case ticks <= -foreverTicks:
+		return Duration{ticks: -foreverTicks}
+	}
+	return Duration{ticks: int64(ticks)}
 }
 
 func Forever() Duration {
-	return Duration{beats: float32(math.Inf(1))}
+	return Duration{ticks: foreverTicks}
 }
 
 func (d Duration) Beats() float32 {
-	return d.beats
+	if d.ticks == foreverTicks {
+		return float32(math.Inf(1))
+	}
+	return float32(d.ticks) / TicksPerBeat
 }
 
 func (d Duration) IsZero() bool {
-	return d.beats == 0
+	return d.ticks == 0
 }
 
 func (d Duration) VisuallyZero() bool {
-	return math.Abs(float64(d.beats)) < float64(VisualSlack.beats)
+	ticks := d.ticks
+	if ticks < 0 {
+		ticks = -ticks
+	}
+	return ticks < VisualSlack.ticks
 }
 
+// Moment in beats since the epoch. The zero value is not a valid time, so it
+// can stand for unset.
 type Time struct {
-	beat float32
+	tick  int64
+	valid bool
 }
 
 func (b Time) String() string {
-	return fmt.Sprintf("beat=%.2f", b.beat)
+	if !b.valid {
+		return "beat=unset"
+	}
+	return fmt.Sprintf("beat=%.2f", b.Beat())
 }
 
 func OnBeat(beat float32) Time {
-	return Time{beat: beat}
+	return Time{tick: Beats(beat).ticks, valid: true}
 }
 
-func (b Time) After(other Time) bool {
-	return b.beat > other.beat
+// Beats since the epoch.
+func (b Time) Beat() float32 {
+	if b.tick == foreverTicks {
+		return float32(math.Inf(1))
+	}
+	return float32(b.tick) / TicksPerBeat
 }
 
-func (b Time) Before(other Time) bool {
-	return b.beat < other.beat
+func (b Time) Valid() bool {
+	return b.valid
 }
 
-func (b Time) IsZero() bool {
-	return b.beat == 0
+func (b Time) After(other Time) bool {
+	return b.tick > other.tick
+}
+
+func (b Time) Before(other Time) bool {
+	return b.tick < other.tick
 }
 
 func (b Time) VisuallyClose(other Time) bool {
@@ -113,16 +174,31 @@ func (b Time) Same(other Time) bool {
 }
 
 func (b Time) Add(d Duration) Time {
-	return Time{beat: b.beat + d.beats}
+	if b.tick == foreverTicks || d.ticks == foreverTicks || (d.ticks > 0 && b.tick > foreverTicks-d.ticks) {
+		return Time{tick: foreverTicks, valid: b.valid}
+	}
+	return Time{tick: b.tick + d.ticks, valid: b.valid}
 }
 
 func (b Time) Sub(d Duration) Time {
-	return Time{beat: b.beat - d.beats}
+	if b.tick == foreverTicks {
+		return b
+	}
+	return Time{tick: b.tick - d.ticks, valid: b.valid}
 }
 
 func (b Time) Delta(other Time) Duration {
-	return Duration{beats: b.beat - other.beat}
+	if b.tick == foreverTicks {
+		return Forever()
+	}
+	return Duration{ticks: b.tick - other.tick}
 }
+
+// Time rounded down to a multiple of the duration, or as is if the duration
+// is shorter than a tick.
 func (b Time) Truncate(d Duration) Time {
-	return Time{beat: float32(math.Trunc(float64(b.beat/d.beats))) * d.beats}
+	if d.ticks <= 0 {
+		return b
+	}
+	return Time{tick: b.tick / d.ticks * d.ticks, valid: b.valid}
 }
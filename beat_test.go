@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFrozenAtEpoch(t *testing.T) {
+	pulse := NewPulse(60)
+	pulse.frozen = OnBeat(0)
+	if !pulse.IsFrozen() {
+		t.Errorf("frozen on beat 0 should still be frozen")
+	}
+	if got := pulse.Horizon(); !got.Same(OnBeat(0)) {
+		t.Errorf("got horizon %v, want beat 0", got)
+	}
+}
+
+func TestSyncAtArrival(t *testing.T) {
+	pulse := NewPulse(60)
+	// Applied a while after arriving a little past beat 10
+	at := pulse.epoch.Add(10*time.Second + 100*time.Millisecond)
+	pulse.Sync(120, at)
+	if got := pulse.At(at); !got.Same(OnBeat(10)) {
+		t.Errorf("got %v at arrival, want beat 10", got)
+	}
+	if got := pulse.At(at.Add(time.Second)); !got.Same(OnBeat(12)) {
+		t.Errorf("got %v a second later, want beat 12", got)
+	}
+}
+
+func TestLongSessionPrecision(t *testing.T) {
+	// Several hours in at 140 BPM, a 32nd note is still apart from the beat
+	beat := OnBeat(140 * 60 * 5)
+	step := beat.Add(Beats(1.0 / 8))
+	if !step.After(beat) || step.VisuallyClose(beat) {
+		t.Errorf("%v should be apart from %v", step, beat)
+	}
+	if got := step.Truncate(Beats(1)); !got.Same(beat) {
+		t.Errorf("got truncated %v, want %v", got, beat)
+	}
+	if got := step.Delta(beat).Beats(); got != 1.0/8 {
+		t.Errorf("got delta %v, want 0.125", got)
+	}
+}
+
+func TestBeatsSaturate(t *testing.T) {
+	if got := Beats(float32(math.NaN())); !got.IsZero() {
+		t.Errorf("got %v for NaN, want zero", got)
+	}
+	if got := Beats(1e30); got != Forever() {
+		t.Errorf("got %v for 1e30 beats, want forever", got)
+	}
+	if got := Beats(-1e30); got.Beats() > 0 {
+		t.Errorf("got %v for -1e30 beats, want negative", got)
+	}
+}
+
+func TestTruncateSubTick(t *testing.T) {
+	beat := OnBeat(3.5)
+	if got := beat.Truncate(Beats(1.0 / 4000)); !got.Same(beat) {
+		t.Errorf("got %v truncated to less than a tick, want %v", got, beat)
+	}
+}
+
+func TestForever(t *testing.T) {
+	end := OnBeat(10).Add(Forever())
+	if !end.After(OnBeat(1e6)) {
+		t.Errorf("%v should be after any beat", end)
+	}
+	if got := end.Delta(OnBeat(10)); got != Forever() {
+		t.Errorf("got %v, want forever", got)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"image/color"
+	"log"
+	"sync"
+	"time"
+)
+
+// Decoded input, one type for each kind of message.
+type Event interface {
+	// Name for logs and metrics
+	EventName() string
+}
+
+type PlayEvent struct {
+	Instrument string
+	Note       Pitch
+	// Zero to hold it until /stop, played as Forever()
+	Duration Duration
+	Velocity float32
+	// When the message arrived, zero for when applied
+	At time.Time
+}
+
+type StopEvent struct {
+	Instrument string
+	Note       Pitch
+	At         time.Time
+}
+
+type DrumEvent struct {
+	Instrument string
+	// Zero for the default
+	Duration Duration
+	Velocity float32
+	At       time.Time
+}
+
+type LayerEvent struct {
+	Name     string
+	Duration Duration
+	Variant  string
+	At       time.Time
+}
+
+type HighlightEvent struct {
+	Notes []Pitch
+}
+
+// Instrument registered ahead of playing.
+type InstrumentEvent struct {
+	Name  string
+	Track string
+	// Nil to keep the palette color
+	Color color.Color
+	Label string
+	// Negative to keep the order of arrival
+	Order int
+}
+
+type RangeEvent struct {
+	Policy RangePolicy
+	// Only if fixed
+	Low, High Pitch
+}
+
+type SyncEvent struct {
+	Bpm int
+	At  time.Time
+}
+
+// Not drawn yet, but passed on to any sinks that want it.
+type AutomationEvent struct {
+	Arguments []interface{}
+}
+
+// What the tracks drew for an event, with the positions, colors and labels
+// worked out, published from the game loop.
+type DrawnEvent struct {
+	Web *WebEvent
+}
+
+func (*PlayEvent) EventName() string       { return "play" }
+func (*StopEvent) EventName() string       { return "stop" }
+func (*DrumEvent) EventName() string       { return "drum" }
+func (*LayerEvent) EventName() string      { return "layer" }
+func (*HighlightEvent) EventName() string  { return "highlight" }
+func (*SyncEvent) EventName() string       { return "sync" }
+func (*InstrumentEvent) EventName() string { return "instrument" }
+func (*RangeEvent) EventName() string      { return "range" }
+func (*AutomationEvent) EventName() string { return "automation" }
+func (*DrawnEvent) EventName() string      { return "drawn" }
+
+// Consumer of the events, called from a goroutine of its own, one event at a
+// time and in the order published.
+type Sink interface {
+	Handle(event Event)
+}
+
+// What to do when a sink falls behind and its buffer is full. Only sinks
+// that never publish themselves should block, as the game loop publishes the
+// drawn events.
+type Overflow int
+
+const (
+	// Hold up the publisher until there is room
+	Block Overflow = iota
+	// Drop the new event
+	DropNewest
+	// Drop the oldest buffered event to make room
+	DropOldest
+)
+
+type subscription struct {
+	name     string
+	sink     Sink
+	events   chan Event
+	overflow Overflow
+}
+
+// Fans out the published events to the subscribed sinks.
+type Bus struct {
+	subscriptions []*subscription
+
+	mu sync.Mutex
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Start passing events to the sink, buffering up to `buffer` of them.
+func (bus *Bus) Subscribe(name string, sink Sink, buffer int, overflow Overflow) {
+	sub := &subscription{
+		name:     name,
+		sink:     sink,
+		events:   make(chan Event, buffer),
+		overflow: overflow,
+	}
+	go func() {
+		for event := range sub.events {
+			sub.sink.Handle(event)
+		}
+	}()
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.subscriptions = append(bus.subscriptions, sub)
+}
+
+func (bus *Bus) Publish(event Event) {
+	// Held throughout to keep the order the same for every sink
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for _, sub := range bus.subscriptions {
+		sub.send(event)
+	}
+}
+
+func (sub *subscription) send(event Event) {
+	switch sub.overflow {
+	case Block:
+		sub.events <- event
+		return
+	case DropNewest:
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped(event)
+		}
+	case DropOldest:
+		for {
+			select {
+			case sub.events <- event:
+				return
+			default:
+			}
+			select {
+			case old := <-sub.events:
+				sub.dropped(old)
+			default:
+			}
+		}
+	}
+}
+
+func (sub *subscription) dropped(event Event) {
+	log.Printf("Sink %s too slow, dropping %s event", sub.name, event.EventName())
+	metrics.Dropped(sub.name)
+}
+
+// Queue the event to be drawn, applied on the game loop.
+func (trosces *Trosces) Handle(event Event) {
+	if _, ok := event.(*DrawnEvent); ok {
+		// Drawn already
+		return
+	}
+	trosces.events <- event
+}
+
+var warnAutomation sync.Once
+
+func (trosces *Trosces) apply(event Event) {
+	switch e := event.(type) {
+	case *PlayEvent:
+		trosces.PlayNote(e.Instrument, e.Note, trosces.pulse.At(e.At), e.Duration, e.Velocity)
+	case *StopEvent:
+		trosces.StopNote(e.Instrument, e.Note, trosces.pulse.At(e.At))
+	case *DrumEvent:
+		trosces.PlayDrum(e.Instrument, trosces.pulse.At(e.At), e.Duration, e.Velocity)
+	case *LayerEvent:
+		trosces.PlayLayer(e.Name, trosces.pulse.At(e.At), e.Duration, e.Variant)
+	case *HighlightEvent:
+		trosces.SetHighlight(trosces.tuning.KeysOf(e.Notes))
+	case *SyncEvent:
+		trosces.Sync(e.Bpm, e.At)
+	case *RangeEvent:
+		trosces.SetKeyboardRange(e.Policy, e.Low, e.High)
+	case *InstrumentEvent:
+		trosces.DeclareInstrument(e.Track, e.Name, e.Color, e.Label, e.Order)
+	case *AutomationEvent:
+		// TODO: plot automation values
+		warnAutomation.Do(func() {
+			log.Printf("/automation not drawn yet, only passed on to the sinks")
+		})
+	}
+}
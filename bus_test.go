@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the events, optionally waiting before each.
+type recordingSink struct {
+	events chan Event
+	wait   chan struct{}
+}
+
+func (sink *recordingSink) Handle(event Event) {
+	if sink.wait != nil {
+		<-sink.wait
+	}
+	sink.events <- event
+}
+
+func received(t *testing.T, sink *recordingSink, n int) []int {
+	var bpms []int
+	for i := 0; i < n; i++ {
+		select {
+		case event := <-sink.events:
+			bpms = append(bpms, event.(*SyncEvent).Bpm)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events, want %d", len(bpms), n)
+		}
+	}
+	return bpms
+}
+
+func TestBus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		overflow Overflow
+		want     []int
+	}{
+		{
+			name:     "block keeps everything",
+			overflow: Block,
+			want:     []int{0, 1, 2, 3, 4},
+		},
+		{
+			name:     "drop newest keeps the first",
+			overflow: DropNewest,
+			want:     []int{0, 1, 2},
+		},
+		{
+			name:     "drop oldest keeps the last",
+			overflow: DropOldest,
+			want:     []int{0, 3, 4},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bus := NewBus()
+			sink := &recordingSink{events: make(chan Event, 10), wait: make(chan struct{})}
+			bus.Subscribe("test", sink, 2, tc.overflow)
+
+			// The first event is taken by the sink, which then stalls unless
+			// blocking, so the rest overflow the buffer
+			bus.Publish(&SyncEvent{Bpm: 0})
+			time.Sleep(10 * time.Millisecond)
+			if tc.overflow == Block {
+				close(sink.wait)
+			}
+			for bpm := 1; bpm < 5; bpm++ {
+				bus.Publish(&SyncEvent{Bpm: bpm})
+			}
+			if tc.overflow != Block {
+				close(sink.wait)
+			}
+
+			got := received(t, sink, len(tc.want))
+			for i := range tc.want {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// Events from many goroutines, and the HTTP handlers reading the state, are
+// all applied on the game loop. Meant to be run with -race.
+func TestConcurrentInput(t *testing.T) {
+	// Not touching the saved instruments
+	*registryPath = ""
+	trosces := NewTrosces()
+	const senders, notes = 4, 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instrument := fmt.Sprintf("synth%d", i)
+			for j := 0; j < notes; j++ {
+				note := Pitch(60 + j%12)
+				trosces.bus.Publish(&PlayEvent{Instrument: instrument, Note: note, Velocity: 1})
+				trosces.bus.Publish(&StopEvent{Instrument: instrument, Note: note})
+				trosces.bus.Publish(&DrumEvent{Instrument: "kick", Velocity: 1})
+				trosces.bus.Publish(&LayerEvent{Name: "bass", Duration: Beats(1), Variant: fmt.Sprint(j % 3)})
+				trosces.bus.Publish(&HighlightEvent{Notes: []Pitch{note}})
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			trosces.webSnapshot()
+			response := httptest.NewRecorder()
+			trosces.serveState(response, httptest.NewRequest("GET", "/state", nil))
+			if response.Code != http.StatusOK {
+				t.Errorf("/state: got status %d", response.Code)
+			}
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// The game loop
+	deadline := time.After(5 * time.Second)
+	for {
+		trosces.applyPending()
+		select {
+		case <-deadline:
+			t.Fatalf("got %d drum hits, want %d", trosces.drums.trail.Stats().spans, senders*notes)
+		case <-done:
+			if trosces.drums.trail.Stats().spans == senders*notes {
+				if got := len(trosces.keyboard.mapper.Names()); got != senders {
+					t.Errorf("got %d instruments, want %d", got, senders)
+				}
+				return
+			}
+		default:
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// The browsers get what was drawn through the bus.
+func TestWebHubSink(t *testing.T) {
+	*registryPath = ""
+	*httpAddr = "127.0.0.1:0"
+	defer func() { *httpAddr = "" }()
+	trosces := NewTrosces()
+	client := make(chan []byte, 1)
+	trosces.web.clients[client] = struct{}{}
+
+	trosces.PlayDrum("kick", trosces.pulse.Now(), Beats(1), 1)
+	select {
+	case data := <-client:
+		if !strings.Contains(string(data), `"type":"span"`) {
+			t.Errorf("got %s, want the kick span", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("got nothing, want the kick span")
+	}
+}
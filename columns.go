@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"sort"
+)
+
+var (
+	compactKeyboard  = flag.Bool("compact", false, "Show only the keyboard notes that were played, collapsing the others")
+	compactHighlight = flag.Bool("compact-highlight", true, "Keep the highlighted notes on the compact keyboard too")
+)
+
+// Positions shown side by side: every one from min to max, only some of
+// them when compact, or folded into the degrees of the tuning, like the 12
+// pitch classes.
+type Columns struct {
+	layout   Layout
+	tuning   *Tuning
+	min, max int
+	// Positions shown in order, nil if all of them. One for each pitch class
+	// if folded.
+	positions []int
+	// Column by position, or by pitch class if folded
+	index map[int]int
+}
+
+func NewColumns(min int, max int) *Columns {
+	return &Columns{min: min, max: max}
+}
+
+// Only the positions within min and max, collapsing the others. Just min if
+// there are none, so that there is always a column.
+func NewCompactColumns(min int, max int, positions []int) *Columns {
+	columns := &Columns{min: min, max: max, index: map[int]int{}}
+	sorted := append([]int{}, positions...)
+	sort.Ints(sorted)
+	for _, pos := range sorted {
+		if _, ok := columns.index[pos]; ok || pos < min || pos > max {
+			continue
+		}
+		columns.index[pos] = len(columns.positions)
+		columns.positions = append(columns.positions, pos)
+	}
+	if len(columns.positions) == 0 {
+		columns.index[min] = 0
+		columns.positions = []int{min}
+	}
+	return columns
+}
+
+func (columns *Columns) Count() int {
+	if columns.index != nil {
+		return len(columns.positions)
+	}
+	return columns.max - columns.min + 1
+}
+
+// Column of the position, if shown.
+func (columns *Columns) Of(pos int) (int, bool) {
+	if columns.layout != LinearLayout {
+		if pos < columns.min || pos > columns.max {
+			return 0, false
+		}
+		return columns.index[columns.tuning.Degree(pos)], true
+	}
+	if columns.index != nil {
+		column, ok := columns.index[pos]
+		return column, ok
+	}
+	return pos - columns.min, pos >= columns.min && pos <= columns.max
+}
+
+// Position in the column, if any.
+func (columns *Columns) At(column int) (int, bool) {
+	if column < 0 || column >= columns.Count() {
+		return 0, false
+	}
+	if columns.index != nil {
+		return columns.positions[column], true
+	}
+	return columns.min + column, true
+}
+
+// Whether positions were collapsed between the column and the previous one.
+func (columns *Columns) GapBefore(column int) bool {
+	if columns.index == nil || columns.layout != LinearLayout || column <= 0 || column >= len(columns.positions) {
+		return false
+	}
+	return columns.positions[column]-columns.positions[column-1] > 1
+}
+
+// Positions sharing a column, e.g. the same note in any octave if folded, are
+// the same once folded.
+func (columns *Columns) Fold(pos int) int {
+	if columns.layout != LinearLayout {
+		return columns.tuning.Degree(pos)
+	}
+	return pos
+}
+
+func (columns *Columns) Equal(other *Columns) bool {
+	if other == nil || columns.layout != other.layout || columns.tuning != other.tuning || columns.min != other.min || columns.max != other.max {
+		return false
+	}
+	if (columns.index == nil) != (other.index == nil) || len(columns.positions) != len(other.positions) {
+		return false
+	}
+	for i := range columns.positions {
+		if columns.positions[i] != other.positions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Show only the positions played, and highlighted if withHighlight, or all
+// of them again.
+func (trail *Trail) SetCompact(compact bool, withHighlight bool) {
+	trail.compact = compact
+	trail.compactHighlight = withHighlight
+	trail.updateColumns()
+}
+
+// Width of the trail, or of each cycle in the cycle-stacked view.
+func (trail *Trail) width() float32 {
+	return trail.posWidth * float32(trail.columns.Count())
+}
+
+// Make room for a new span at the position, if compact.
+func (trail *Trail) fitColumns(pos int) {
+	if !trail.compact || trail.layout != LinearLayout || pos < trail.minPos || pos > trail.maxPos {
+		return
+	}
+	if _, ok := trail.columns.Of(pos); !ok {
+		trail.updateColumns()
+	}
+}
+
+// Lay out the columns again, e.g. after the range or the positions played
+// have changed.
+func (trail *Trail) updateColumns() {
+	var columns *Columns
+	if trail.layout != LinearLayout {
+		columns = NewFoldedColumns(trail.layout, trail.tuning, trail.minPos, trail.maxPos)
+	} else if trail.compact {
+		positions := trail.spans.Positions()
+		if trail.compactHighlight {
+			for pos := range trail.highlight {
+				positions = append(positions, pos)
+			}
+		}
+		columns = NewCompactColumns(trail.minPos, trail.maxPos, positions)
+	} else {
+		columns = NewColumns(trail.minPos, trail.maxPos)
+	}
+	if !columns.Equal(trail.columns) {
+		trail.columns = columns
+		trail.resetAll()
+	}
+}
+
+// Show or hide the compact keyboard on all the keyboard tracks.
+func (trosces *Trosces) SetCompact(compact bool) {
+	trosces.compact = compact
+	tracks, _ := trosces.namedTracks("keyboard")
+	for _, track := range tracks {
+		track.trail.SetCompact(compact, *compactHighlight)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompactColumns(t *testing.T) {
+	trail := NewTrail(Beats(1), Beats(4), 192, 15)
+	trail.pulse = NewPulse(60)
+	trail.rangeAlign = 12
+	trail.SetHighlight([]int{67})
+	trail.SetCompact(true, true)
+
+	trail.Span(0, 64, Beats(1))
+	trail.Span(0, 60, Beats(1))
+	trail.Span(0, 64, Beats(1))
+
+	columns := trail.columns
+	var shown []int
+	for column := 0; column < columns.Count(); column++ {
+		pos, _ := columns.At(column)
+		shown = append(shown, pos)
+	}
+	if want := []int{60, 64, 67}; !reflect.DeepEqual(shown, want) {
+		t.Errorf("got columns %v, want %v", shown, want)
+	}
+	if column, ok := columns.Of(64); !ok || column != 1 {
+		t.Errorf("got column %d, %v of 64, want 1", column, ok)
+	}
+	if _, ok := columns.Of(62); ok {
+		t.Errorf("got a column for 62, want none")
+	}
+	if columns.GapBefore(0) || !columns.GapBefore(1) || !columns.GapBefore(2) {
+		t.Errorf("want gaps before the columns of 64 and 67 only")
+	}
+
+	trail.SetCompact(false, true)
+	if count := trail.columns.Count(); count != 12 {
+		t.Errorf("got %d columns back from compact, want 12", count)
+	}
+	if trail.columns.GapBefore(4) {
+		t.Errorf("want no gaps when not compact")
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/hypebeast/go-osc/osc"
+)
+
+// Controls of the UI itself, shared by the hotkeys and the /trosces/...
+// OSC messages.
+
+var (
+	screenshotDir = flag.String("screenshot-dir", ".", "Directory to save screenshots in")
+)
+
+var trackNames = []string{"keyboard", "drums", "layers"}
+
+// Run the action on the game loop, without waiting for it.
+func (trosces *Trosces) Do(action func()) {
+	select {
+	case trosces.actions <- action:
+	default:
+		log.Printf("Too many pending actions, dropping one")
+		metrics.Dropped("actions")
+	}
+}
+
+// Run the action on the game loop and wait for it to finish. Returns
+// whether it was run at all.
+func (trosces *Trosces) Wait(action func()) bool {
+	done := make(chan struct{})
+	select {
+	case trosces.actions <- func() {
+		action()
+		close(done)
+	}:
+	default:
+		log.Printf("Too many pending actions, dropping one")
+		metrics.Dropped("actions")
+		return false
+	}
+	<-done
+	return true
+}
+
+func (trosces *Trosces) runActions() {
+	for {
+		select {
+		case action := <-trosces.actions:
+			action()
+		default:
+			return
+		}
+	}
+}
+
+// Apply the events received since the last frame.
+func (trosces *Trosces) applyEvents() {
+	// Only those already there, to not hold up the frame
+	for n := len(trosces.events); n > 0; n-- {
+		trosces.apply(<-trosces.events)
+	}
+}
+
+// Catch up with the input and housekeeping, once per frame on the game loop.
+// All the state drawn is changed from here only, so it needs no locks.
+func (trosces *Trosces) applyPending() {
+	trosces.applyEvents()
+	trosces.runActions()
+	for _, name := range trackNames {
+		tracks, _ := trosces.namedTracks(name)
+		for _, track := range tracks {
+			track.trail.Tidy()
+		}
+	}
+	trosces.saveRegistry()
+}
+
+// Tracks by name, including the template for new per-instrument keyboards.
+func (trosces *Trosces) namedTracks(name string) ([]*Track, error) {
+	switch name {
+	case "keyboard":
+		tracks := []*Track{trosces.keyboard}
+		if *splitKeyboard != "" {
+			tracks = append(tracks, trosces.keyboardTracks()...)
+		}
+		return tracks, nil
+	case "drums":
+		return []*Track{trosces.drums}, nil
+	case "layers":
+		return []*Track{trosces.layers}, nil
+	}
+	return nil, fmt.Errorf("unknown track %q", name)
+}
+
+// Named tracks, or the keyboard and drums if no name is given.
+func (trosces *Trosces) tracksOrDefault(name string) ([]*Track, error) {
+	if name != "" {
+		return trosces.namedTracks(name)
+	}
+	keyboards, _ := trosces.namedTracks("keyboard")
+	return append(keyboards, trosces.drums), nil
+}
+
+func (trosces *Trosces) SetFrozen(frozen bool) {
+	trosces.pulse.SetFrozen(frozen)
+}
+
+// Most grid steps per beat, fine enough for 64th notes.
+const maxGridSteps = 64
+
+func (trosces *Trosces) SetGridSteps(steps int, tracks []*Track) {
+	for _, track := range tracks {
+		track.trail.SetGridSteps(steps)
+	}
+}
+
+// Bounds of the visible length, and of the cycle.
+var (
+	minLength = Beats(1.0 / 16)
+	maxLength = Beats(256)
+)
+
+// The length, within minLength and maxLength.
+func clampLength(length Duration) Duration {
+	if length.Beats() < minLength.Beats() {
+		return minLength
+	}
+	if length.Beats() > maxLength.Beats() {
+		return maxLength
+	}
+	return length
+}
+
+// Zoom by changing the duration visible on the trails, within bounds.
+func (trosces *Trosces) SetLength(length Duration, tracks []*Track) {
+	length = clampLength(length)
+	for _, track := range tracks {
+		track.trail.SetLength(length)
+	}
+}
+
+func (trosces *Trosces) SetTrackHidden(name string, hidden bool) {
+	trosces.hidden[name] = hidden
+}
+
+// Forget all the spans, but keep the instruments.
+func (trosces *Trosces) Clear(tracks []*Track) {
+	for _, track := range tracks {
+		track.trail.Clear()
+		if track == trosces.keyboard {
+			trosces.instruments = map[int]*Track{}
+		}
+	}
+}
+
+func (trosces *Trosces) SetPalette(name string) error {
+	palette, ok := palettes[name]
+	if !ok {
+		return fmt.Errorf("unknown palette %q", name)
+	}
+	spanPalette = palette
+	trosces.paletteName = name
+	for _, name := range trackNames {
+		tracks, _ := trosces.namedTracks(name)
+		for _, track := range tracks {
+			track.trail.Redraw()
+		}
+	}
+	return nil
+}
+
+// Switch to the next palette.
+func (trosces *Trosces) CyclePalette() {
+	for i, name := range paletteNames {
+		if name == trosces.paletteName {
+			if err := trosces.SetPalette(paletteNames[(i+1)%len(paletteNames)]); err != nil {
+				log.Printf("Failed to cycle palette: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// Save the next frame drawn as a PNG file of the name in -screenshot-dir.
+func (trosces *Trosces) Screenshot(name string) {
+	if name == "" {
+		name = time.Now().Format("trosces-20060102-150405.png")
+	}
+	trosces.screenshot = filepath.Join(*screenshotDir, name)
+}
+
+// Plain file name, without any directory, for files named in OSC messages.
+func checkFileName(name string) error {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("not a file name: %q", name)
+	}
+	return nil
+}
+
+// Optional track name argument.
+// Checked off the game loop, so without looking at the tracks.
+func isTrackName(name string) bool {
+	for _, trackName := range trackNames {
+		if name == trackName {
+			return true
+		}
+	}
+	return false
+}
+
+func trackArg(args []interface{}, i int) (string, error) {
+	if len(args) <= i {
+		return "", nil
+	}
+	return NameArg(args[i])
+}
+
+func addControlHandlers(d *countingDispatcher, trosces *Trosces) {
+	d.AddMsgHandler("/trosces/freeze", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 0, 1); err != nil {
+			invalid("/trosces/freeze", "Invalid /trosces/freeze: %v", err)
+			return
+		}
+
+		if len(msg.Arguments) == 0 {
+			trosces.Do(trosces.pulse.ToggleFrozen)
+			return
+		}
+
+		var frozen int
+		if frozen, err = NumberArg(msg.Arguments[0]); err != nil {
+			invalid("/trosces/freeze", "Invalid /trosces/freeze[0] frozen: %v", err)
+			return
+		}
+
+		trosces.Do(func() { trosces.SetFrozen(frozen != 0) })
+	})
+
+	d.AddMsgHandler("/trosces/compact", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 0, 1); err != nil {
+			invalid("/trosces/compact", "Invalid /trosces/compact: %v", err)
+			return
+		}
+
+		if len(msg.Arguments) == 0 {
+			trosces.Do(func() { trosces.SetCompact(!trosces.compact) })
+			return
+		}
+
+		var compact int
+		if compact, err = NumberArg(msg.Arguments[0]); err != nil {
+			invalid("/trosces/compact", "Invalid /trosces/compact[0] compact: %v", err)
+			return
+		}
+
+		trosces.Do(func() { trosces.SetCompact(compact != 0) })
+	})
+
+	d.AddMsgHandler("/trosces/layout", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 1, 1); err != nil {
+			invalid("/trosces/layout", "Invalid /trosces/layout: %v", err)
+			return
+		}
+
+		var (
+			name   string
+			layout Layout
+		)
+
+		if name, err = NameArg(msg.Arguments[0]); err == nil {
+			layout, err = ParseLayout(name)
+		}
+		if err != nil {
+			invalid("/trosces/layout", "Invalid /trosces/layout[0] layout: %v", err)
+			return
+		}
+
+		trosces.Do(func() { trosces.SetLayout(layout) })
+	})
+
+	d.AddMsgHandler("/trosces/grid", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 1, 2); err != nil {
+			invalid("/trosces/grid", "Invalid /trosces/grid: %v", err)
+			return
+		}
+
+		var (
+			steps int
+			track string
+		)
+
+		if steps, err = NumberArg(msg.Arguments[0]); err == nil && (steps < 1 || steps > maxGridSteps) {
+			err = fmt.Errorf("not within 1..%d", maxGridSteps)
+		}
+		if err != nil {
+			invalid("/trosces/grid", "Invalid /trosces/grid[0] steps: %v", err)
+			return
+		}
+
+		if track, err = trackArg(msg.Arguments, 1); err != nil {
+			invalid("/trosces/grid", "Invalid /trosces/grid[1] track: %v", err)
+			return
+		}
+
+		trosces.Do(func() {
+			if tracks, err := trosces.tracksOrDefault(track); err != nil {
+				invalid("/trosces/grid", "Invalid /trosces/grid[1] track: %v", err)
+			} else {
+				trosces.SetGridSteps(steps, tracks)
+			}
+		})
+	})
+
+	d.AddMsgHandler("/trosces/zoom", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 1, 2); err != nil {
+			invalid("/trosces/zoom", "Invalid /trosces/zoom: %v", err)
+			return
+		}
+
+		var (
+			length Duration
+			track  string
+		)
+
+		if length, err = DurationArg(msg.Arguments[0]); err != nil || length.Beats() <= 0 {
+			invalid("/trosces/zoom", "Invalid /trosces/zoom[0] length: %v", err)
+			return
+		}
+
+		if track, err = trackArg(msg.Arguments, 1); err != nil {
+			invalid("/trosces/zoom", "Invalid /trosces/zoom[1] track: %v", err)
+			return
+		}
+
+		trosces.Do(func() {
+			if tracks, err := trosces.tracksOrDefault(track); err != nil {
+				invalid("/trosces/zoom", "Invalid /trosces/zoom[1] track: %v", err)
+			} else {
+				trosces.SetLength(length, tracks)
+			}
+		})
+	})
+
+	for _, hidden := range []bool{false, true} {
+		hidden := hidden
+		path := "/trosces/show"
+		if hidden {
+			path = "/trosces/hide"
+		}
+
+		d.AddMsgHandler(path, func(msg *osc.Message) {
+			var err error
+			if err = CheckArgs(msg.Arguments, 1, 1); err != nil {
+				invalid(path, "Invalid %s: %v", path, err)
+				return
+			}
+
+			var track string
+
+			if track, err = NameArg(msg.Arguments[0]); err != nil {
+				invalid(path, "Invalid %s[0] track: %v", path, err)
+				return
+			}
+			if !isTrackName(track) {
+				invalid(path, "Invalid %s[0] track: unknown track %q", path, track)
+				return
+			}
+
+			trosces.Do(func() { trosces.SetTrackHidden(track, hidden) })
+		})
+	}
+
+	d.AddMsgHandler("/trosces/clear", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 0, 1); err != nil {
+			invalid("/trosces/clear", "Invalid /trosces/clear: %v", err)
+			return
+		}
+
+		var track string
+
+		if track, err = trackArg(msg.Arguments, 0); err != nil {
+			invalid("/trosces/clear", "Invalid /trosces/clear[0] track: %v", err)
+			return
+		}
+
+		trosces.Do(func() {
+			names := trackNames
+			if track != "" {
+				names = []string{track}
+			}
+			for _, name := range names {
+				if tracks, err := trosces.namedTracks(name); err != nil {
+					invalid("/trosces/clear", "Invalid /trosces/clear[0] track: %v", err)
+				} else {
+					trosces.Clear(tracks)
+				}
+			}
+		})
+	})
+
+	d.AddMsgHandler("/trosces/palette", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 1, 1); err != nil {
+			invalid("/trosces/palette", "Invalid /trosces/palette: %v", err)
+			return
+		}
+
+		var name string
+
+		if name, err = NameArg(msg.Arguments[0]); err != nil {
+			invalid("/trosces/palette", "Invalid /trosces/palette[0] name: %v", err)
+			return
+		}
+
+		trosces.Do(func() {
+			if err := trosces.SetPalette(name); err != nil {
+				invalid("/trosces/palette", "Invalid /trosces/palette[0] name: %v", err)
+			}
+		})
+	})
+
+	d.AddMsgHandler("/trosces/screenshot", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 0, 1); err != nil {
+			invalid("/trosces/screenshot", "Invalid /trosces/screenshot: %v", err)
+			return
+		}
+
+		var name string
+
+		if len(msg.Arguments) == 1 {
+			if name, err = NameArg(msg.Arguments[0]); err == nil && name != "" {
+				err = checkFileName(name)
+			}
+			if err != nil {
+				invalid("/trosces/screenshot", "Invalid /trosces/screenshot[0] name: %v", err)
+				return
+			}
+		}
+
+		trosces.Do(func() { trosces.Screenshot(name) })
+	})
+}
@@ -0,0 +1,139 @@
+//go:build !tui
+// +build !tui
+
+package main
+
+import (
+	"context"
+	"image/color"
+	"math"
+	"runtime/trace"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+func (tooltip *Tooltip) Draw(screen *ebiten.Image) {
+	const margin = 4
+	var width float32
+	for _, line := range tooltip.lines {
+		if w := labelWidth(line); w > width {
+			width = w
+		}
+	}
+	width += 2 * margin
+	height := float32(len(tooltip.lines))*labelHeight() + 2*margin
+
+	// Next to the cursor, but within the screen
+	left, top := tooltip.x+12, tooltip.y+12
+	if right := float32(screen.Bounds().Max.X); left+width > right {
+		left = tooltip.x - width - margin
+	}
+	if bottom := float32(screen.Bounds().Max.Y); top+height > bottom {
+		top = bottom - height
+	}
+
+	fillRect(screen, left, top, left+width, top+height, theme.TooltipBorder)
+	fillRect(screen, left+1, top+1, left+width-1, top+height-1, theme.TooltipBackground)
+	for i, line := range tooltip.lines {
+		drawLabel(screen, line, left+margin, top+margin+float32(i)*labelHeight(), theme.PanelText)
+	}
+}
+
+func (grid *StepGrid) Draw(ctxt context.Context, screen *ebiten.Image, op *ebiten.DrawImageOptions) {
+	defer trace.StartRegion(ctxt, "DrawStepGrid").End()
+	trail := grid.trail
+	now := trail.pulse.Horizon()
+	fadeOut := Beats(grid.loop.Beats() * float32(grid.loops))
+	levels := grid.Levels(now, trail.VisibleSpans(now.Sub(fadeOut), now))
+	current := grid.Step(now)
+
+	x, y := op.GeoM.Apply(0, 0)
+	left, top := float32(x), float32(y)
+	stepHeight := trail.length.Beats() * trail.beatSize / float32(grid.steps)
+	stepsPerBeat := int(math.Round(float64(float32(grid.steps) / grid.loop.Beats())))
+	halfBorder := trail.borderWidth / 2
+
+	for step := 0; step < grid.steps; step++ {
+		cellTop := top + float32(step)*stepHeight
+		for column := 0; column < trail.columns.Count(); column++ {
+			pos, _ := trail.columns.At(column)
+			cellLeft := left + float32(column)*trail.posWidth
+
+			var background color.Color
+			switch {
+			case step == current:
+				background = theme.StepCurrent
+			case stepsPerBeat > 0 && step%stepsPerBeat == 0:
+				background = theme.StepBeat
+			default:
+				background = theme.StepCell
+			}
+			fillRect(screen, cellLeft, cellTop, cellLeft+trail.posWidth, cellTop+stepHeight, theme.StepBorder)
+			fillRect(
+				screen,
+				cellLeft+halfBorder, cellTop+halfBorder,
+				cellLeft+trail.posWidth-halfBorder, cellTop+stepHeight-halfBorder,
+				background,
+			)
+
+			if level, ok := levels[StepCell{pos: pos, step: step}]; ok {
+				fillRect(
+					screen,
+					cellLeft+trail.borderWidth, cellTop+trail.borderWidth,
+					cellLeft+trail.posWidth-trail.borderWidth, cellTop+stepHeight-trail.borderWidth,
+					fade(trail.SpanColor(level.id), level.level),
+				)
+			}
+		}
+	}
+}
+
+func fillRect(image *ebiten.Image, x0, y0, x1, y1 float32, c color.Color) {
+	path := vector.Path{}
+	path.MoveTo(x0, y0)
+	path.LineTo(x0, y1)
+	path.LineTo(x1, y1)
+	path.LineTo(x1, y0)
+	path.Fill(image, &vector.FillOptions{Color: c})
+}
+
+// Draw the pattern over the rectangle.
+func drawPattern(image *ebiten.Image, pattern Pattern, x0, y0, x1, y1 float32) {
+	shade := color.RGBA{0, 0, 0, patternAlpha}
+	switch pattern {
+	case Stripes:
+		// Diagonal bands where x+y is within the first third of the period
+		first := float32(math.Floor(float64(x0+y0)/patternPeriod)) * patternPeriod
+		for k := first; k < x1+y1; k += patternPeriod {
+			band := []point{{x0, y0}, {x0, y1}, {x1, y1}, {x1, y0}}
+			band = clipPolygon(band, 1, 1, k+patternPeriod/3)
+			band = clipPolygon(band, -1, -1, -k)
+			if len(band) < 3 {
+				continue
+			}
+			path := vector.Path{}
+			path.MoveTo(band[0].x, band[0].y)
+			for _, p := range band[1:] {
+				path.LineTo(p.x, p.y)
+			}
+			path.Fill(image, &vector.FillOptions{Color: shade})
+		}
+	case Dots:
+		const size = 2
+		firstX := float32(math.Ceil(float64(x0)/patternPeriod)) * patternPeriod
+		firstY := float32(math.Ceil(float64(y0)/patternPeriod)) * patternPeriod
+		for y := firstY; y+size <= y1; y += patternPeriod {
+			for x := firstX; x+size <= x1; x += patternPeriod {
+				fillRect(image, x, y, x+size, y+size, shade)
+			}
+		}
+		if firstX+size > x1 {
+			// Too narrow for the grid, one column in the middle
+			x := (x0 + x1 - size) / 2
+			for y := firstY; y+size <= y1; y += patternPeriod {
+				fillRect(image, x, y, x+size, y+size, shade)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+//go:build !tui
+// +build !tui
+
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"log"
+	"os"
+	"runtime/trace"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+// Drawn in a window rather than the terminal.
+const terminalBuild = false
+
+func (track *Track) Draw(ctx context.Context, image *ebiten.Image, op *ebiten.DrawImageOptions) {
+	trailOp := *op
+	trailOp.GeoM.Translate(0, float64(track.header.keyHeight))
+	for column := 1; column < track.trail.Columns(); column++ {
+		headerOp := *op
+		headerOp.GeoM.Translate(float64(column)*float64(track.header.Width()), 0)
+		track.header.Draw(image, &headerOp)
+	}
+	if track.showStepGrid {
+		track.stepGrid.Draw(ctx, image, &trailOp)
+	} else {
+		track.trail.Draw(ctx, image, &trailOp)
+	}
+	track.header.Draw(image, op)
+}
+
+// Implements ebiten.Game interface.
+
+func (trosces *Trosces) Update() error {
+	_, task := trace.NewTask(context.Background(), "UpdateTrosces")
+	defer task.End()
+
+	// Events, remote controls and cleanup
+	trosces.applyPending()
+
+	// Header matches the trail.
+	for _, track := range trosces.keyboardTracks() {
+		track.Resolve()
+	}
+	trosces.drums.Resolve()
+	trosces.layers.Resolve()
+
+	// Grid steps
+	defaultTracks, _ := trosces.tracksOrDefault("")
+	if inpututil.IsKeyJustPressed(ebiten.Key3) {
+		trosces.SetGridSteps(3, defaultTracks)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.Key4) {
+		trosces.SetGridSteps(4, defaultTracks)
+	}
+
+	// Zoom
+	if inpututil.IsKeyJustPressed(ebiten.KeyMinus) {
+		trosces.SetLength(Beats(trosces.keyboard.trail.length.Beats()*2), defaultTracks)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyEqual) && trosces.keyboard.trail.length.Beats() > 1 {
+		trosces.SetLength(Beats(trosces.keyboard.trail.length.Beats()/2), defaultTracks)
+	}
+
+	// Show/hide tracks
+	for i, key := range []ebiten.Key{ebiten.KeyF1, ebiten.KeyF2, ebiten.KeyF3} {
+		if inpututil.IsKeyJustPressed(key) {
+			name := trackNames[i]
+			trosces.SetTrackHidden(name, !trosces.hidden[name])
+		}
+	}
+
+	// Clear history
+	if inpututil.IsKeyJustPressed(ebiten.KeyBackspace) {
+		for _, name := range trackNames {
+			tracks, _ := trosces.namedTracks(name)
+			trosces.Clear(tracks)
+		}
+	}
+
+	// Palette, theme and screenshot
+	if inpututil.IsKeyJustPressed(ebiten.KeyP) {
+		trosces.CyclePalette()
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyT) {
+		trosces.CycleTheme()
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF12) {
+		trosces.Screenshot("")
+	}
+
+	// Compact keyboard and its layout
+	if inpututil.IsKeyJustPressed(ebiten.KeyK) {
+		trosces.SetCompact(!trosces.compact)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyO) {
+		trosces.CycleLayout()
+	}
+
+	// Cycle-stacked keyboard and its cycle length
+	var cycleChanged bool
+	if inpututil.IsKeyJustPressed(ebiten.KeyC) {
+		trosces.cycleView = !trosces.cycleView
+		cycleChanged = true
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyLeftBracket) && trosces.cycle.Beats() > 1 {
+		trosces.cycle = clampLength(Beats(trosces.cycle.Beats() / 2))
+		cycleChanged = true
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyRightBracket) {
+		trosces.cycle = clampLength(Beats(trosces.cycle.Beats() * 2))
+		cycleChanged = true
+	}
+	if cycleChanged {
+		for _, track := range trosces.keyboardTracks() {
+			trosces.setCycle(track)
+		}
+	}
+
+	// Tooltip for the span under the cursor
+	trosces.hover = trosces.tooltipAt(ebiten.CursorPosition())
+
+	// Select keys and pads, mute and solo from the legend
+	if inpututil.IsMouseButtonJustPressed(ebiten.MouseButtonLeft) {
+		x, y := ebiten.CursorPosition()
+		if !trosces.clickLegend(x, y) {
+			trosces.click(x, y)
+		}
+	}
+
+	// Solo instruments one by one
+	if inpututil.IsKeyJustPressed(ebiten.KeyTab) {
+		track := "keyboard"
+		if ebiten.IsKeyPressed(ebiten.KeyShift) {
+			track = "drums"
+		}
+		trosces.SoloNext(track)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyU) {
+		for track := range trosces.visibility {
+			trosces.SetMuted(track, nil)
+			trosces.SetSoloed(track, nil)
+		}
+	}
+
+	// Labels
+	if inpututil.IsKeyJustPressed(ebiten.KeyL) {
+		trosces.showLegend = !trosces.showLegend
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyV) {
+		trosces.layers.trail.SetShowLabels(!trosces.layers.trail.showLabels)
+	}
+
+	// Drums as a step sequencer grid
+	if inpututil.IsKeyJustPressed(ebiten.KeyG) {
+		trosces.drums.showStepGrid = !trosces.drums.showStepGrid
+	}
+
+	// Freeze
+	if inpututil.IsKeyJustPressed(ebiten.KeySpace) {
+		trosces.pulse.ToggleFrozen()
+	}
+
+	// Maybe finish.
+	if inpututil.IsKeyJustPressed(ebiten.KeyQ) || inpututil.IsKeyJustPressed(ebiten.KeyEscape) {
+		return Finished
+	}
+
+	return nil
+}
+
+func (trosces *Trosces) Draw(screen *ebiten.Image) {
+	ctx, task := trace.NewTask(context.Background(), "DrawTrosces")
+	defer task.End()
+	started := time.Now()
+	defer func() { metrics.ObserveDraw(time.Since(started)) }()
+
+	screen.Fill(theme.Background)
+	for _, placement := range trosces.placements() {
+		op := ebiten.DrawImageOptions{}
+		op.GeoM.Translate(float64(placement.x), float64(placement.y))
+		placement.track.Draw(ctx, screen, &op)
+	}
+
+	if trosces.showLegend {
+		trosces.drawLegend(screen)
+	}
+	if trosces.hover != nil {
+		trosces.hover.Draw(screen)
+	}
+
+	if trosces.screenshot != "" {
+		trosces.saveScreenshot(screen, trosces.screenshot)
+		trosces.screenshot = ""
+	}
+}
+
+func (trosces *Trosces) Layout(outsideWidth, outsideHeight int) (int, int) {
+	trosces.width = outsideWidth
+
+	keyboards := trosces.keyboardTracks()
+	keyboardHeight := float32(outsideHeight)
+	if *splitKeyboard == "stack" {
+		keyboardHeight /= float32(len(keyboards))
+	}
+	for _, track := range keyboards {
+		track.trail.SetBeatSize((keyboardHeight - track.header.keyHeight) / track.trail.length.Beats())
+	}
+
+	height := float32(outsideHeight) - trosces.drums.header.keyHeight
+	trosces.drums.trail.SetBeatSize(height / trosces.drums.trail.length.Beats())
+	trosces.layers.trail.SetBeatSize(height / trosces.layers.trail.length.Beats())
+	return outsideWidth, outsideHeight
+}
+
+func (trosces *Trosces) saveScreenshot(screen *ebiten.Image, path string) {
+	bounds := screen.Bounds()
+	pixels := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixels.Set(x, y, screen.At(x, y))
+		}
+	}
+
+	go func() {
+		f, err := os.Create(path)
+		if err != nil {
+			log.Printf("Could not create screenshot file: %v", err)
+			return
+		}
+		defer f.Close()
+		if err := png.Encode(f, pixels); err != nil {
+			log.Printf("Could not write screenshot: %v", err)
+			return
+		}
+		log.Printf("Saved screenshot to %s", path)
+	}()
+}
+
+// Show the trosces in a window until closed.
+func run(trosces *Trosces) error {
+	ebiten.SetWindowTitle("TrOSCes")
+	ebiten.SetWindowResizable(true)
+	//ebiten.SetScreenClearedEveryFrame(false)
+	//ebiten.SetMaxTPS(60)
+
+	err := ebiten.RunGame(trosces)
+	if errors.Is(err, Finished) {
+		return nil
+	}
+	return err
+}
@@ -8,4 +8,7 @@ require (
 	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20201108214237-06ea97f0c265 // indirect
 	github.com/hajimehoshi/ebiten/v2 v2.0.3
 	github.com/hypebeast/go-osc v0.0.0-20200115085105-85fee7fed692
+	golang.org/x/image v0.0.0-20200927104501-e162460cd6b5
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
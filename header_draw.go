@@ -0,0 +1,208 @@
+//go:build !tui
+// +build !tui
+
+package main
+
+import (
+	"image/color"
+	"log"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+type headerImages struct {
+	base    *ebiten.Image
+	overlay *ebiten.Image
+}
+
+// Drop the images, to be drawn again with the current keys.
+func (header *Header) resetImages() {
+	header.base = nil
+	header.overlay = nil
+	header.overlayReady = false
+}
+
+func (header *Header) Draw(image *ebiten.Image, op *ebiten.DrawImageOptions) {
+	image.DrawImage(header.getBase(), op)
+	image.DrawImage(header.getOverlay(), op)
+}
+
+// Internal
+
+func (header *Header) drawKey(image *ebiten.Image, column int, note int, active, highlight bool) {
+	halfBorder := header.borderWidth / 2
+	halfWidth := header.keyWidth / 2
+	blackHeight := header.keyHeight * 0.25
+
+	baseOffset := float32(column) * header.keyWidth
+	keyOffset := baseOffset + halfBorder
+	keyEndOffset := baseOffset + header.keyWidth - halfBorder
+	// Black keys cut into the white ones only if right next to them
+	left, leftOk := header.columns.At(column - 1)
+	right, rightOk := header.columns.At(column + 1)
+	fold := header.columns.Fold
+	leftBlack := leftOk && fold(left) == fold(note-1) && !header.tuning.IsWhite(note-1)
+	rightBlack := rightOk && fold(right) == fold(note+1) && !header.tuning.IsWhite(note+1)
+
+	if column == 0 {
+		keyOffset += halfBorder
+	}
+	if column == header.columns.Count()-1 {
+		keyEndOffset -= halfBorder
+	}
+
+	path := vector.Path{}
+	if header.tuning.IsWhite(note) {
+		if leftBlack {
+			extraOffset := keyOffset - halfWidth
+			path.MoveTo(extraOffset, header.borderWidth)
+			path.LineTo(extraOffset, blackHeight-halfBorder)
+			path.LineTo(keyOffset, blackHeight-halfBorder)
+			path.LineTo(keyOffset, header.keyHeight-header.borderWidth)
+		} else {
+			path.MoveTo(keyOffset, header.borderWidth)
+			path.LineTo(keyOffset, header.keyHeight-header.borderWidth)
+		}
+		if rightBlack {
+			extraOffset := keyEndOffset + halfWidth
+			path.LineTo(keyEndOffset, header.keyHeight-header.borderWidth)
+			path.LineTo(keyEndOffset, blackHeight-halfBorder)
+			path.LineTo(extraOffset, blackHeight-halfBorder)
+			path.LineTo(extraOffset, header.borderWidth)
+		} else {
+			path.LineTo(keyEndOffset, header.keyHeight-header.borderWidth)
+			path.LineTo(keyEndOffset, header.borderWidth)
+		}
+	} else {
+		path.MoveTo(keyOffset, blackHeight+halfBorder)
+		path.LineTo(keyOffset, header.keyHeight-header.borderWidth)
+		path.LineTo(keyEndOffset, header.keyHeight-header.borderWidth)
+		path.LineTo(keyEndOffset, blackHeight+halfBorder)
+	}
+	var keyColor color.Color
+	if header.tuning.IsWhite(note) {
+		if active {
+			keyColor = theme.WhiteKeyActive
+		} else if highlight {
+			keyColor = theme.WhiteKeyHighlight
+		} else {
+			keyColor = theme.WhiteKey
+		}
+	} else {
+		if active {
+			keyColor = theme.BlackKeyActive
+		} else if highlight {
+			keyColor = theme.BlackKeyHighlight
+		} else {
+			keyColor = theme.BlackKey
+		}
+	}
+	op := vector.FillOptions{Color: keyColor}
+	path.Fill(image, &op)
+}
+
+func (header *Header) drawPad(image *ebiten.Image, column int, active, highlight bool) {
+	halfBorder := header.borderWidth / 2
+	baseOffset := float32(column) * header.keyWidth
+	keyOffset := baseOffset + halfBorder
+	keyEndOffset := baseOffset + header.keyWidth - halfBorder
+
+	path := vector.Path{}
+	path.MoveTo(keyOffset, header.borderWidth)
+	path.LineTo(keyOffset, header.keyHeight-header.borderWidth)
+	path.LineTo(keyEndOffset, header.keyHeight-header.borderWidth)
+	path.LineTo(keyEndOffset, header.borderWidth)
+	var padColor color.Color
+	if active {
+		padColor = theme.WhiteKeyActive
+	} else if highlight {
+		padColor = theme.WhiteKeyHighlight
+	} else {
+		padColor = theme.WhiteKey
+	}
+	op := vector.FillOptions{Color: padColor}
+	path.Fill(image, &op)
+}
+
+// Octave markers on the keyboard, names on the pads.
+func (header *Header) drawLabels(image *ebiten.Image) {
+	bottom := header.keyHeight - header.borderWidth - labelHeight()
+	for column := 0; column < header.columns.Count(); column++ {
+		pos, _ := header.columns.At(column)
+		offset := float32(column)*header.keyWidth + header.borderWidth
+		width := header.keyWidth - 2*header.borderWidth
+		var label string
+		if header.keyboard && header.columns.layout != LinearLayout {
+			// Every pitch class, as the octaves are folded together
+			label = fitLabel(header.tuning.DegreeName(pos), width)
+		} else if header.keyboard {
+			if header.tuning.IsRepeat(pos) {
+				label = header.tuning.Name(pos)
+			}
+		} else {
+			label = fitLabel(header.labels[pos], width)
+		}
+		if label != "" {
+			x := offset + (width-labelWidth(label))/2
+			drawLabel(image, label, x, bottom, theme.KeyLabel)
+		}
+	}
+}
+
+func (header *Header) getBase() *ebiten.Image {
+	if header.base == nil {
+		log.Printf("New header base image")
+		header.base = ebiten.NewImage(int(header.Width()), int(header.keyHeight))
+		header.base.Fill(theme.KeyBorder)
+
+		for column := 0; column < header.columns.Count(); column++ {
+			note, _ := header.columns.At(column)
+			if header.keyboard {
+				header.drawKey(header.base, column, note, false, false)
+			} else {
+				header.drawPad(header.base, column, false, false)
+			}
+			if header.columns.GapBefore(column) {
+				// Notch where keys were collapsed
+				x := float32(column) * header.keyWidth
+				fillRect(header.base, x-header.borderWidth, 0, x+header.borderWidth, header.keyHeight/4, theme.GapMarker)
+			}
+		}
+	}
+	return header.base
+}
+
+// Key or pad of the note on the overlay, if shown.
+func (header *Header) drawOverlayKey(note int, active, highlight bool) {
+	column, ok := header.columns.Of(note)
+	if !ok {
+		return
+	}
+	if header.keyboard {
+		header.drawKey(header.overlay, column, note, active, highlight)
+	} else {
+		header.drawPad(header.overlay, column, active, highlight)
+	}
+}
+
+func (header *Header) getOverlay() *ebiten.Image {
+	if !header.overlayReady {
+		if header.overlay == nil {
+			header.overlay = ebiten.NewImage(int(header.Width()), int(header.keyHeight))
+		}
+		header.overlay.Fill(color.Transparent)
+
+		for _, note := range header.highlight {
+			header.drawOverlayKey(note, false, true)
+		}
+		for _, note := range header.active {
+			header.drawOverlayKey(note, true, false)
+		}
+
+		header.drawLabels(header.overlay)
+
+		header.overlayReady = true
+	}
+	return header.overlay
+}
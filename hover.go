@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Details of a span shown next to the mouse cursor.
+type Tooltip struct {
+	x, y  float32
+	lines []string
+}
+
+// Tooltip for the span under the screen coordinates, if any.
+func (trosces *Trosces) tooltipAt(cursorX, cursorY int) *Tooltip {
+	x, y := float32(cursorX), float32(cursorY)
+	for _, placement := range trosces.placements() {
+		track := placement.track
+		if x < placement.x || x >= placement.x+track.Width() || y < placement.y || y >= placement.y+track.Height() {
+			continue
+		}
+		subSpan := track.SubSpanAt(x-placement.x, y-placement.y)
+		if subSpan == nil {
+			return nil
+		}
+		return &Tooltip{x: x, y: y, lines: trosces.describe(track, subSpan)}
+	}
+	return nil
+}
+
+func (trosces *Trosces) describe(track *Track, subSpan *SubSpan) []string {
+	span := subSpan.span
+	var lines []string
+	switch track {
+	case trosces.drums:
+		lines = append(lines, "drum: "+track.mapper.Label(span.id))
+	case trosces.layers:
+		lNum, _ := track.mapper.IdAt(span.pos)
+		lines = append(lines,
+			"layer: "+track.mapper.Label(lNum),
+			"variant: "+trosces.variantName(span),
+		)
+	default:
+		lines = append(lines,
+			"instrument: "+track.mapper.Label(span.id),
+			"note: "+track.trail.SpanPitch(span).String(),
+		)
+	}
+
+	lines = append(lines, fmt.Sprintf("start: beat %.2f", span.start.Beat()))
+	if duration := span.end.Delta(span.start).Beats(); math.IsInf(float64(duration), 1) {
+		lines = append(lines, "duration: held")
+	} else {
+		lines = append(lines, fmt.Sprintf("duration: %.2f beats", duration))
+	}
+	lines = append(lines,
+		fmt.Sprintf("velocity: %.2f", span.velocity),
+		fmt.Sprintf("lane: %d/%d", subSpan.subindex+1, subSpan.subindices),
+	)
+	return lines
+}
+
+// Span under the position within the track, if any.
+func (track *Track) SubSpanAt(x, y float32) *SubSpan {
+	if track.showStepGrid {
+		return nil
+	}
+	return track.trail.SubSpanAt(x, y-track.header.keyHeight)
+}
+
+// Span under the position within the trail, if any.
+func (trail *Trail) SubSpanAt(x, y float32) *SubSpan {
+	if x < 0 || y < 0 || y >= trail.length.Beats()*trail.beatSize {
+		return nil
+	}
+	width := trail.width()
+	now := trail.pulse.Horizon()
+
+	// Undo the layout of the trail to find the moment
+	var t Time
+	if trail.cycleView {
+		column := int(x / width)
+		if column >= trail.cycles {
+			return nil
+		}
+		x -= float32(column) * width
+		cycleBeatSize := trail.length.Beats() * trail.beatSize / trail.cycle.Beats()
+		cycleStart := now.Truncate(trail.cycle).Sub(Beats(trail.cycle.Beats() * float32(trail.cycles-1-column)))
+		t = cycleStart.Add(Beats(y / cycleBeatSize))
+		if t.After(now) {
+			return nil
+		}
+	} else {
+		t = now.Sub(Beats(y / trail.beatSize))
+	}
+	if x >= width {
+		return nil
+	}
+	column := int(x / trail.posWidth)
+
+	bucketTime := t.Truncate(trail.bucketSize)
+	for _, subSpan := range trail.bucketSubSpans(bucketTime) {
+		if spanColumn, _ := trail.columns.Of(subSpan.span.pos); spanColumn != column || t.Before(subSpan.start) || t.After(subSpan.end) {
+			continue
+		}
+		_, _, offset, endOffset := trail.subSpanBounds(bucketTime, subSpan)
+		if x >= offset && x <= endOffset {
+			// Copy, as the span may still be changed by Stop
+			found := *subSpan
+			span := *subSpan.span
+			found.span = &span
+			return &found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sort"
+)
+
+// Spans of a trail indexed for range queries. Spans no longer than `short`
+// are kept sorted by start, so a query only looks at those starting within
+// `short` before the range. Longer ones, including held notes, are kept
+// aside, also sorted by start so a query stops at the end of the range. Spans still playing are also indexed by ID and position for
+// stopping them, and counted by position.
+type SpanIndex struct {
+	short Duration
+	// Short spans by start
+	sorted []*Span
+	// Spans longer than short by start
+	long []*Span
+	// Possibly still playing spans by ID and position
+	open map[spanKey][]*Span
+	// Number of spans by position
+	counts map[int]int
+}
+
+type spanKey struct {
+	id  int
+	pos int
+}
+
+func NewSpanIndex(short Duration) *SpanIndex {
+	return &SpanIndex{
+		short:  short,
+		open:   map[spanKey][]*Span{},
+		counts: map[int]int{},
+	}
+}
+
+func (index *SpanIndex) Len() int {
+	return len(index.sorted) + len(index.long)
+}
+
+func (index *SpanIndex) Add(span *Span) {
+	if span.end.Delta(span.start).Beats() > index.short.Beats() {
+		index.long = insertByStart(index.long, span)
+	} else {
+		index.sorted = insertByStart(index.sorted, span)
+	}
+	index.counts[span.pos]++
+
+	// Forget the ones of the same key over by now
+	key := spanKey{id: span.id, pos: span.pos}
+	open := index.open[key][:0]
+	for _, other := range index.open[key] {
+		if other.end.After(span.start) {
+			open = append(open, other)
+		}
+	}
+	index.open[key] = append(open, span)
+}
+
+// End the span with the ID and position still playing at the time, if any.
+func (index *SpanIndex) Stop(id int, pos int, now Time) *Span {
+	key := spanKey{id: id, pos: pos}
+	spans := index.open[key]
+	var stopped *Span
+	playing := spans[:0]
+	for _, span := range spans {
+		if !span.end.After(now) {
+			// Already over
+			continue
+		}
+		if stopped == nil {
+			span.end = now
+			stopped = span
+			continue
+		}
+		playing = append(playing, span)
+	}
+	if len(playing) == 0 {
+		delete(index.open, key)
+	} else {
+		index.open[key] = playing
+	}
+	return stopped
+}
+
+// Spans (partially) within the time range, ordered by start for the short
+// ones.
+func (index *SpanIndex) Query(start Time, end Time) []*Span {
+	var spans []*Span
+	first := sort.Search(len(index.sorted), func(i int) bool {
+		return !index.sorted[i].start.Before(start.Sub(index.short))
+	})
+	for _, span := range index.sorted[first:] {
+		if span.start.After(end) {
+			break
+		}
+		if span.InRange(start, end) {
+			spans = append(spans, span)
+		}
+	}
+	for _, span := range index.long {
+		if span.start.After(end) {
+			break
+		}
+		if span.InRange(start, end) {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// Insert the span after the ones starting no later. Usually the latest, but
+// the pulse may have been synced back a bit.
+func insertByStart(spans []*Span, span *Span) []*Span {
+	i := sort.Search(len(spans), func(i int) bool {
+		return spans[i].start.After(span.start)
+	})
+	spans = append(spans, nil)
+	copy(spans[i+1:], spans[i:])
+	spans[i] = span
+	return spans
+}
+
+// Positions of any of the spans, in no particular order.
+func (index *SpanIndex) Positions() []int {
+	positions := make([]int, 0, len(index.counts))
+	for pos := range index.counts {
+		positions = append(positions, pos)
+	}
+	return positions
+}
+
+// All the spans, ordered by start.
+func (index *SpanIndex) All() []*Span {
+	spans := make([]*Span, 0, index.Len())
+	spans = append(spans, index.sorted...)
+	spans = append(spans, index.long...)
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+	return spans
+}
+
+// Forget the spans that ended before the time.
+func (index *SpanIndex) Prune(before Time) {
+	// Short spans starting earlier than that have all ended
+	first := sort.Search(len(index.sorted), func(i int) bool {
+		return !index.sorted[i].start.Before(before.Sub(index.short))
+	})
+	for _, span := range index.sorted[:first] {
+		index.uncount(span)
+	}
+	sorted := []*Span{}
+	for i, span := range index.sorted[first:] {
+		if !span.start.Before(before) {
+			sorted = append(sorted, index.sorted[first+i:]...)
+			break
+		}
+		if !span.end.Before(before) {
+			sorted = append(sorted, span)
+		} else {
+			index.uncount(span)
+		}
+	}
+	index.sorted = sorted
+
+	// Filtered in place, keeping them sorted
+	long := index.long[:0]
+	for _, span := range index.long {
+		if !span.end.Before(before) {
+			long = append(long, span)
+		} else {
+			index.uncount(span)
+		}
+	}
+	index.long = long
+
+	for key, spans := range index.open {
+		open := spans[:0]
+		for _, span := range spans {
+			if !span.end.Before(before) {
+				open = append(open, span)
+			}
+		}
+		if len(open) == 0 {
+			delete(index.open, key)
+		} else {
+			index.open[key] = open
+		}
+	}
+}
+
+func (index *SpanIndex) uncount(span *Span) {
+	index.counts[span.pos]--
+	if index.counts[span.pos] == 0 {
+		delete(index.counts, span.pos)
+	}
+}
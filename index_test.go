@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func spanStarts(spans []*Span) []float32 {
+	var starts []float32
+	for _, span := range spans {
+		starts = append(starts, span.start.Beat())
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts
+}
+
+func TestSpanIndex(t *testing.T) {
+	index := NewSpanIndex(Beats(1))
+	for _, span := range []*Span{
+		{id: 0, pos: 0, start: OnBeat(0), end: OnBeat(0.5)},
+		{id: 0, pos: 1, start: OnBeat(2), end: OnBeat(2.5)},
+		// Added out of order
+		{id: 0, pos: 0, start: OnBeat(1), end: OnBeat(1.5)},
+		// Held
+		{id: 1, pos: 0, start: OnBeat(1.5), end: OnBeat(1.5).Add(Forever())},
+		{id: 0, pos: 0, start: OnBeat(4), end: OnBeat(4.25)},
+	} {
+		index.Add(span)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		start, end Time
+		want       []float32
+	}{
+		{"before all", OnBeat(-2), OnBeat(-1), nil},
+		{"overlapping the start", OnBeat(0.25), OnBeat(1.25), []float32{0, 1}},
+		{"held ones", OnBeat(3), OnBeat(3.5), []float32{1.5}},
+		{"everything", OnBeat(0), OnBeat(10), []float32{0, 1, 1.5, 2, 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := spanStarts(index.Query(tc.start, tc.end))
+			if len(got) != len(tc.want) {
+				t.Fatalf("got starts %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if !AlmostEqual(got[i], tc.want[i]) {
+					t.Fatalf("got starts %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+
+	if stopped := index.Stop(1, 0, OnBeat(5)); stopped == nil || !stopped.end.Same(OnBeat(5)) {
+		t.Errorf("held span should be stopped at beat 5, got %v", stopped)
+	}
+	if stopped := index.Stop(1, 0, OnBeat(6)); stopped != nil {
+		t.Errorf("nothing more to stop, got %v", stopped)
+	}
+
+	if got := index.Positions(); len(got) != 2 {
+		t.Errorf("got positions %v, want 0 and 1", got)
+	}
+
+	index.Prune(OnBeat(3))
+	if got := spanStarts(index.Query(OnBeat(0), OnBeat(10))); len(got) != 2 {
+		t.Errorf("got starts %v after pruning, want [1.5 4]", got)
+	}
+	if got := index.Positions(); len(got) != 1 || got[0] != 0 {
+		t.Errorf("got positions %v after pruning, want just 0", got)
+	}
+}
+
+func TestSpanIndexLongOrder(t *testing.T) {
+	index := NewSpanIndex(Beats(1))
+	// Long ones added out of order, as when synced back
+	for _, start := range []float32{8, 2, 5} {
+		index.Add(&Span{start: OnBeat(start), end: OnBeat(start + 4)})
+	}
+	got := spanStarts(index.Query(OnBeat(3), OnBeat(6)))
+	if len(got) != 2 || !AlmostEqual(got[0], 2) || !AlmostEqual(got[1], 5) {
+		t.Errorf("got starts %v, want [2 5]", got)
+	}
+	index.Prune(OnBeat(7))
+	got = spanStarts(index.Query(OnBeat(0), OnBeat(20)))
+	if len(got) != 2 || !AlmostEqual(got[0], 5) || !AlmostEqual(got[1], 8) {
+		t.Errorf("got starts %v after pruning, want [5 8]", got)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !tui
+// +build !tui
+
+package main
+
+import (
+	"image/color"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+)
+
+var labelFace font.Face = basicfont.Face7x13
+
+func labelWidth(label string) float32 {
+	return float32(text.BoundString(labelFace, label).Dx())
+}
+
+func labelHeight() float32 {
+	return float32(labelFace.Metrics().Height.Ceil())
+}
+
+// Truncate the label to fit within the width.
+func fitLabel(label string, width float32) string {
+	runes := []rune(label)
+	for len(runes) > 0 && labelWidth(string(runes)) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes)
+}
+
+// Draw the label with its top left corner at x, y.
+func drawLabel(image *ebiten.Image, label string, x, y float32, c color.Color) {
+	ascent := labelFace.Metrics().Ascent.Ceil()
+	text.Draw(image, label, labelFace, int(x), int(y)+ascent, c)
+}
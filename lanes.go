@@ -0,0 +1,109 @@
+package main
+
+// Overlapping spans of a column, sharing its width equally.
+type LaneGroup struct {
+	start Time
+	count int
+}
+
+// Lanes of a column, allocated to the spans as they start. A span keeps its
+// lane for its whole life, so it doesn't jump around between buckets.
+type Voices struct {
+	group *LaneGroup
+	// Span in each lane, nil once free
+	lanes []*Span
+}
+
+// Put the span in the lowest free lane. Returns whether earlier spans of the
+// group got narrower for it.
+func (voices *Voices) Assign(span *Span) bool {
+	free := -1
+	busy := 0
+	for i, other := range voices.lanes {
+		if other != nil && other.end.Before(span.start.Add(VisualSlack)) {
+			voices.lanes[i] = nil
+			other = nil
+		}
+		if other != nil {
+			busy++
+		} else if free < 0 {
+			free = i
+		}
+	}
+	if busy == 0 {
+		// Nothing left to share the width with, start over
+		voices.group = &LaneGroup{start: span.start}
+		voices.lanes = voices.lanes[:0]
+		free = -1
+	}
+	if free < 0 {
+		free = len(voices.lanes)
+		voices.lanes = append(voices.lanes, nil)
+	}
+	voices.lanes[free] = span
+	span.lane = free
+	span.lanes = voices.group
+
+	if len(voices.lanes) > voices.group.count {
+		narrower := voices.group.count > 0
+		voices.group.count = len(voices.lanes)
+		return narrower
+	}
+	return false
+}
+
+// Allocate a lane for the new span. Hidden spans take no room from others.
+func (trail *Trail) assignLane(span *Span) {
+	if trail.isHidden(span.id) {
+		span.lane = 0
+		span.lanes = &LaneGroup{start: span.start, count: 1}
+		return
+	}
+	// Shared by the positions drawn in the same column
+	key := trail.columns.Fold(span.pos)
+	voices, ok := trail.voices[key]
+	if !ok {
+		voices = &Voices{}
+		trail.voices[key] = voices
+	}
+	if voices.Assign(span) {
+		for t := voices.group.start.Truncate(trail.bucketSize); !t.After(span.start); t = t.Add(trail.bucketSize) {
+			trail.redrawBucket(t)
+		}
+	}
+}
+
+// Allocate the lanes again from scratch, e.g. when spans were hidden.
+func (trail *Trail) reassignLanes() {
+	trail.voices = map[int]*Voices{}
+	for _, span := range trail.spans.All() {
+		trail.assignLane(span)
+	}
+}
+
+// Span drawn within its lane.
+func laneSpan(span *Span) *SubSpan {
+	subSpan := &SubSpan{
+		span:       span,
+		start:      span.start,
+		end:        span.end,
+		subindex:   span.lane,
+		subindices: 1,
+		first:      true,
+		last:       true,
+	}
+	if span.lanes != nil {
+		subSpan.subindices = span.lanes.count
+	}
+	return subSpan
+}
+
+// Spans to be drawn on the bucket image, in their lanes.
+func (trail *Trail) bucketSubSpans(bucketTime Time) []*SubSpan {
+	spans := trail.bucketSpans(bucketTime)
+	subSpans := make([]*SubSpan, len(spans))
+	for i, span := range spans {
+		subSpans[i] = laneSpan(span)
+	}
+	return subSpans
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	keyboardLayout = flag.String("layout", "linear", "Layout of the keyboard: \"linear\", \"pitch-class\" folding the octaves together, or \"fifths\" along the circle of fifths")
+)
+
+// How the keyboard positions are laid out in columns.
+type Layout int
+
+const (
+	// A column for each note, low to high
+	LinearLayout Layout = iota
+	// A column for each pitch class, C to B, octaves folded together
+	PitchClassLayout
+	// As above, along the circle of fifths from C
+	FifthsLayout
+)
+
+var layoutNames = []string{"linear", "pitch-class", "fifths"}
+
+func ParseLayout(s string) (Layout, error) {
+	for i, name := range layoutNames {
+		if name == s {
+			return Layout(i), nil
+		}
+	}
+	return 0, fmt.Errorf("expected one of %s, got %q", strings.Join(layoutNames, ", "), s)
+}
+
+func (layout Layout) String() string {
+	return layoutNames[layout]
+}
+
+// Degrees of the keys from min to max, like the pitch classes, in the order
+// of the layout, each shown at its lowest key in the range.
+func NewFoldedColumns(layout Layout, tuning *Tuning, min int, max int) *Columns {
+	columns := &Columns{layout: layout, tuning: tuning, min: min, max: max, index: map[int]int{}}
+	step := 1
+	if layout == FifthsLayout {
+		step = tuning.Fifth()
+	}
+	keys := tuning.Keys()
+	for column := 0; column < keys; column++ {
+		degree := column * step % keys
+		pos := min + floorMod(degree-tuning.Degree(min), keys)
+		columns.index[degree] = column
+		columns.positions = append(columns.positions, pos)
+	}
+	return columns
+}
+
+// Lay the positions out differently, sharing the lanes of those folded
+// together.
+func (trail *Trail) SetLayout(layout Layout) {
+	if trail.layout == layout {
+		return
+	}
+	trail.layout = layout
+	trail.updateColumns()
+	trail.reassignLanes()
+	trail.redrawAll()
+}
+
+// Lay out all the keyboard tracks.
+func (trosces *Trosces) SetLayout(layout Layout) {
+	trosces.layout = layout
+	tracks, _ := trosces.namedTracks("keyboard")
+	for _, track := range tracks {
+		track.trail.SetLayout(layout)
+	}
+}
+
+// Switch to the next layout.
+func (trosces *Trosces) CycleLayout() {
+	trosces.SetLayout((trosces.layout + 1) % Layout(len(layoutNames)))
+}
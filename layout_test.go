@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFoldedColumns(t *testing.T) {
+	fifths := NewFoldedColumns(FifthsLayout, equalTemperament, 60, 83)
+	for i, want := range []string{"C", "G", "D", "A", "E", "B", "F#", "C#", "G#", "D#", "A#", "F"} {
+		if pos, ok := fifths.At(i); !ok || Note(pos).PitchName() != want || pos < 60 || pos > 71 {
+			t.Errorf("got %v at column %d, want %s in the lowest octave", Note(pos), i, want)
+		}
+	}
+	if column, ok := fifths.Of(79); !ok || column != 1 {
+		t.Errorf("got column %d, %v of G5, want 1", column, ok)
+	}
+	if _, ok := fifths.Of(84); ok {
+		t.Errorf("got a column out of the range")
+	}
+
+	// Octaves share the column and its lanes
+	trail := NewTrail(Beats(1), Beats(4), 192, 15)
+	trail.pulse = NewPulse(60)
+	trail.rangeAlign = 12
+	trail.Span(0, 62, Beats(1))
+	trail.Span(0, 74, Beats(1))
+	trail.SetLayout(PitchClassLayout)
+	if count := trail.columns.Count(); count != 12 {
+		t.Errorf("got %d columns, want 12", count)
+	}
+	subSpans := trail.bucketSubSpans(OnBeat(0))
+	if len(subSpans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(subSpans))
+	}
+	for _, subSpan := range subSpans {
+		if subSpan.subindices != 2 {
+			t.Errorf("got %d lanes for %v, want 2", subSpan.subindices, subSpan.span)
+		}
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	if layout, err := ParseLayout("fifths"); err != nil || layout != FifthsLayout {
+		t.Errorf("got %v, %v, want fifths", layout, err)
+	}
+	if _, err := ParseLayout("spiral"); err == nil {
+		t.Errorf("want an error for an unknown layout")
+	}
+}
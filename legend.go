@@ -0,0 +1,114 @@
+//go:build !tui
+// +build !tui
+
+package main
+
+import (
+	"image/color"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// Instrument colors in the top right corner.
+type Legend struct {
+	left, top, right, bottom float32
+	entries                  []LegendEntry
+}
+
+type LegendEntry struct {
+	id                       int
+	name                     string
+	left, top, right, bottom float32
+}
+
+const legendMargin = 4
+
+func (trosces *Trosces) legend() *Legend {
+	mapper := trosces.keyboard.mapper
+	names := mapper.Names()
+	if len(names) == 0 {
+		return nil
+	}
+
+	var width float32
+	for id := range names {
+		if w := labelWidth(mapper.Label(id)); w > width {
+			width = w
+		}
+	}
+	lineHeight := labelHeight() + legendMargin
+	width += labelHeight() + 3*legendMargin
+	height := float32(len(names))*lineHeight + legendMargin
+
+	legend := &Legend{
+		right: float32(trosces.width) - legendMargin,
+		top:   trosces.keyboard.header.keyHeight + legendMargin,
+	}
+	legend.left = legend.right - width
+	legend.bottom = legend.top + height
+	for i, id := range mapper.SortedIds() {
+		top := legend.top + legendMargin + float32(i)*lineHeight
+		legend.entries = append(legend.entries, LegendEntry{
+			id:     id,
+			name:   mapper.Label(id),
+			left:   legend.left,
+			top:    top,
+			right:  legend.right,
+			bottom: top + lineHeight,
+		})
+	}
+	return legend
+}
+
+func (trosces *Trosces) drawLegend(screen *ebiten.Image) {
+	legend := trosces.legend()
+	if legend == nil {
+		return
+	}
+	visibility := trosces.visibility["keyboard"]
+
+	swatch := labelHeight()
+	fillRect(screen, legend.left, legend.top, legend.right, legend.bottom, theme.PanelBackground)
+	for _, entry := range legend.entries {
+		swatchColor := trosces.keyboard.trail.SpanColor(entry.id)
+		var labelColor color.Color = theme.PanelText
+		if visibility.muted[entry.id] || (len(visibility.soloed) > 0 && !visibility.soloed[entry.id]) {
+			swatchColor = fade(swatchColor, 0.3)
+			labelColor = theme.PanelDimmedText
+		}
+		if visibility.soloed[entry.id] {
+			// Outline soloed instruments
+			fillRect(screen, entry.left+2, entry.top-2, entry.left+legendMargin+swatch+2, entry.top+swatch+2, theme.PanelText)
+		}
+		fillRect(screen, entry.left+legendMargin, entry.top, entry.left+legendMargin+swatch, entry.top+swatch, swatchColor)
+		drawPattern(screen, trosces.keyboard.trail.SpanPattern(entry.id), entry.left+legendMargin, entry.top, entry.left+legendMargin+swatch, entry.top+swatch)
+		drawLabel(screen, entry.name, entry.left+swatch+2*legendMargin, entry.top, labelColor)
+	}
+}
+
+// Mute (or with shift, solo) the clicked instrument. Returns whether the
+// click was within the legend.
+func (trosces *Trosces) clickLegend(cursorX, cursorY int) bool {
+	if !trosces.showLegend {
+		return false
+	}
+	legend := trosces.legend()
+	if legend == nil {
+		return false
+	}
+	x, y := float32(cursorX), float32(cursorY)
+	if x < legend.left || x >= legend.right || y < legend.top || y >= legend.bottom {
+		return false
+	}
+
+	for _, entry := range legend.entries {
+		if y >= entry.top && y < entry.bottom {
+			if ebiten.IsKeyPressed(ebiten.KeyShift) {
+				trosces.ToggleSoloed("keyboard", entry.id)
+			} else {
+				trosces.ToggleMuted("keyboard", entry.id)
+			}
+		}
+	}
+	return true
+}
@@ -1,16 +1,14 @@
 package main
 
 import (
-	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"runtime/pprof"
 	"runtime/trace"
 	"time"
-
-	"github.com/hajimehoshi/ebiten/v2"
 )
 
 var (
@@ -18,10 +16,14 @@ var (
 	cpuProfile    = flag.String("cpu-profile", "", "Path to CPU profile to be written")
 	memProfile    = flag.String("mem-profile", "", "Path to memory profile to be written")
 	traceFile     = flag.String("trace-file", "", "Path to trace file to be written")
+	tuiMode       = flag.Bool("tui", false, "Draw in the terminal, only in builds with -tags tui, which always do")
 )
 
 func main() {
 	flag.Parse()
+	if *tuiMode && !terminalBuild {
+		log.Fatal("-tui needs the terminal front-end, built with: go build -tags tui")
+	}
 
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
@@ -54,12 +56,12 @@ func main() {
 		go func() {
 			for {
 				if rand.Float32() < 0.1 {
-					note := 32 + rand.Intn(4*12)
-					trosces.keyboard.trail.Span(
-						rand.Intn(7),
-						note,
-						Beats(rand.Float32()*float32(time.Second)),
-					)
+					trosces.bus.Publish(&PlayEvent{
+						Instrument: fmt.Sprintf("synth%d", rand.Intn(7)),
+						Note:       Pitch(32 + rand.Intn(4*12)),
+						Duration:   Beats(rand.Float32() * float32(time.Second)),
+						Velocity:   1,
+					})
 				}
 				time.Sleep(time.Second / 60)
 			}
@@ -74,21 +76,21 @@ func main() {
 					for i := 0; i < 4; i++ {
 						go func() {
 							for i := 0; i < 2; i++ {
-								trosces.drums.trail.Span(0, 0, Beats(1.0/16))
+								trosces.bus.Publish(&DrumEvent{Instrument: "kick", Duration: Beats(1.0 / 16), Velocity: 1})
 								time.Sleep(time.Second / 2)
 							}
 						}()
 						go func() {
 							time.Sleep(time.Second / 4)
-							trosces.drums.trail.Span(1, 1, Beats(1.0/16))
+							trosces.bus.Publish(&DrumEvent{Instrument: "snare", Duration: Beats(1.0 / 16), Velocity: 1})
 							time.Sleep(time.Second / 2)
-							trosces.drums.trail.Span(1, 1, Beats(1.0/16))
+							trosces.bus.Publish(&DrumEvent{Instrument: "snare", Duration: Beats(1.0 / 16), Velocity: 1})
 							time.Sleep(time.Second / 4 / 4 * 3)
-							trosces.drums.trail.Span(1, 1, Beats(1.0/16))
+							trosces.bus.Publish(&DrumEvent{Instrument: "snare", Duration: Beats(1.0 / 16), Velocity: 1})
 						}()
 						go func() {
 							for i := 0; i < 8; i++ {
-								trosces.drums.trail.Span(2, 2, Beats(1.0/16))
+								trosces.bus.Publish(&DrumEvent{Instrument: "hihat", Duration: Beats(1.0 / 16), Velocity: 1})
 								time.Sleep(time.Second / 8)
 							}
 						}()
@@ -98,13 +100,13 @@ func main() {
 
 				// Layers
 				go func() {
+					variant := "a"
 					if rand.Intn(4) == 0 {
-						trosces.layers.trail.Span(1, 0, Beats(4))
-					} else {
-						trosces.layers.trail.Span(0, 0, Beats(4))
+						variant = "b"
 					}
+					trosces.bus.Publish(&LayerEvent{Name: "bass", Duration: Beats(4), Variant: variant})
 					if rand.Intn(4) == 0 {
-						trosces.layers.trail.Span(0, 1, Beats(4))
+						trosces.bus.Publish(&LayerEvent{Name: "lead", Duration: Beats(4), Variant: "a"})
 					}
 				}()
 
@@ -113,16 +115,12 @@ func main() {
 		}()
 	}
 	LaunchOSCServer(trosces)
+	LaunchHTTPServer(trosces)
 
-	ebiten.SetWindowTitle("TrOSCes")
-	ebiten.SetWindowResizable(true)
-	//ebiten.SetScreenClearedEveryFrame(false)
-	//ebiten.SetMaxTPS(60)
-
-	err := ebiten.RunGame(trosces)
-	if err != nil && !errors.Is(err, Finished) {
+	if err := run(trosces); err != nil {
 		log.Fatal(err)
 	}
+	trosces.Close()
 
 	if *memProfile != "" {
 		f, err := os.Create(*memProfile)
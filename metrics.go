@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hypebeast/go-osc/osc"
+)
+
+// Counters and histograms served on /metrics, in Prometheus text format.
+var metrics = NewMetrics()
+
+type Metrics struct {
+	// OSC messages by address
+	messages map[string]uint64
+	// Rejected OSC messages by address
+	invalid map[string]uint64
+	// Events not handled by queue name
+	dropped map[string]uint64
+
+	imagesCreated uint64
+	imagesReused  uint64
+
+	cleanup *Histogram
+	draw    *Histogram
+
+	mu sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	// From a fraction of a frame to several frames
+	buckets := []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1}
+	return &Metrics{
+		messages: map[string]uint64{},
+		invalid:  map[string]uint64{},
+		dropped:  map[string]uint64{},
+		cleanup:  NewHistogram(buckets),
+		draw:     NewHistogram(buckets),
+	}
+}
+
+func (m *Metrics) Message(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages[address]++
+}
+
+func (m *Metrics) Invalid(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invalid[address]++
+}
+
+func (m *Metrics) Dropped(queue string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped[queue]++
+}
+
+func (m *Metrics) ImageAllocated(reused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reused {
+		m.imagesReused++
+	} else {
+		m.imagesCreated++
+	}
+}
+
+func (m *Metrics) ObserveCleanup(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanup.Observe(d.Seconds())
+}
+
+func (m *Metrics) ObserveDraw(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draw.Observe(d.Seconds())
+}
+
+// Cumulative histogram with fixed upper bounds.
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func writeCounters(w io.Writer, name string, help string, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, values[key])
+	}
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeCounters(w, "trosces_osc_messages_total", "OSC messages received.", "address", m.messages)
+	writeCounters(w, "trosces_osc_invalid_total", "OSC messages rejected for invalid arguments.", "address", m.invalid)
+	writeCounters(w, "trosces_dropped_total", "Events dropped for not being handled in time.", "queue", m.dropped)
+	writeCounters(w, "trosces_images_allocated_total", "Trail images allocated.", "source", map[string]uint64{
+		"created": m.imagesCreated,
+		"reused":  m.imagesReused,
+	})
+	m.cleanup.write(w, "trosces_cleanup_seconds", "Time spent discarding old spans and images.")
+	m.draw.write(w, "trosces_frame_draw_seconds", "Time spent drawing a frame.")
+}
+
+// Sizes of the trail for the gauges.
+type TrailStats struct {
+	spans  int
+	cached int
+	unused int
+}
+
+func (trail *Trail) Stats() TrailStats {
+	cached, unused := trail.imageCounts()
+	return TrailStats{
+		spans:  trail.spans.Len(),
+		cached: cached,
+		unused: unused,
+	}
+}
+
+func (trosces *Trosces) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]TrailStats{}
+	if !trosces.Wait(func() {
+		for _, name := range trackNames {
+			tracks, _ := trosces.namedTracks(name)
+			var total TrailStats
+			for _, track := range tracks {
+				s := track.trail.Stats()
+				total.spans += s.spans
+				total.cached += s.cached
+				total.unused += s.unused
+			}
+			stats[name] = total
+		}
+	}) {
+		http.Error(w, "Busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+	gauges := []struct {
+		name, help string
+		value      func(TrailStats) int
+	}{
+		{"trosces_trail_spans", "Spans kept by the trail.", func(s TrailStats) int { return s.spans }},
+		{"trosces_trail_cached_images", "Bucket images drawn and cached by the trail.", func(s TrailStats) int { return s.cached }},
+		{"trosces_trail_unused_images", "Images waiting to be reused by the trail.", func(s TrailStats) int { return s.unused }},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, name := range trackNames {
+			fmt.Fprintf(w, "%s{track=%q} %d\n", gauge.name, name, gauge.value(stats[name]))
+		}
+	}
+}
+
+// Log and count an OSC message with invalid arguments.
+func invalid(address string, format string, v ...interface{}) {
+	metrics.Invalid(address)
+	log.Printf(format, v...)
+}
+
+// Counts the OSC messages before handling them, by address if there is a
+// handler for it, or else as "other" to keep the number of labels in check.
+type countingDispatcher struct {
+	*osc.StandardDispatcher
+	addresses map[string]bool
+}
+
+func newCountingDispatcher() *countingDispatcher {
+	return &countingDispatcher{
+		StandardDispatcher: osc.NewStandardDispatcher(),
+		addresses:          map[string]bool{},
+	}
+}
+
+func (d *countingDispatcher) AddMsgHandler(addr string, handler osc.HandlerFunc) error {
+	d.addresses[addr] = true
+	return d.StandardDispatcher.AddMsgHandler(addr, handler)
+}
+
+func (d *countingDispatcher) Dispatch(packet osc.Packet) {
+	switch p := packet.(type) {
+	case *osc.Message:
+		d.count(p)
+	case *osc.Bundle:
+		for _, msg := range p.Messages {
+			d.count(msg)
+		}
+	}
+	d.StandardDispatcher.Dispatch(packet)
+}
+
+func (d *countingDispatcher) count(msg *osc.Message) {
+	if d.addresses[msg.Address] {
+		metrics.Message(msg.Address)
+	} else {
+		metrics.Message("other")
+	}
+}
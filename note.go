@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -13,6 +16,33 @@ func (n Note) IsWhite() bool {
 	return map[int]bool{0: true, 2: true, 4: true, 5: true, 7: true, 9: true, 11: true}[degree]
 }
 
+// Name of the note, like "C#4".
+func (n Note) String() string {
+	octave := int(n) / 12
+	degree := int(n) % 12
+	if degree < 0 {
+		octave--
+		degree += 12
+	}
+	names := []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+	return fmt.Sprintf("%s%d", names[degree], octave)
+}
+
+// Position within the octave, 0 for C up to 11 for B.
+func (n Note) PitchClass() int {
+	return (int(n)%12 + 12) % 12
+}
+
+// Name of the note without the octave, like "C#".
+func (n Note) PitchName() string {
+	return []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}[n.PitchClass()]
+}
+
+// Name of the note as understood by NewNote and Sonic Pi, like "cs4".
+func (n Note) Symbol() string {
+	return strings.ToLower(strings.Replace(n.String(), "#", "s", 1))
+}
+
 func NewNote(noteStr string) (Note, error) {
 	i := 0
 	note := Note(0)
@@ -57,3 +87,72 @@ func NewNote(noteStr string) (Note, error) {
 
 	return note, nil
 }
+
+// Note, fractional for microtones: 0.25 above a note is 25 cents sharp.
+type Pitch float64
+
+// Pitch of the MIDI note number, which counts from C-1 rather than C0.
+func MIDIPitch(midi float64) Pitch {
+	return Pitch(midi - 12)
+}
+
+// Pitch of the frequency in Hz, A4 being 440.
+func FrequencyPitch(hz float64) Pitch {
+	return Pitch(57 + 12*math.Log2(hz/440))
+}
+
+func (p Pitch) MIDI() float64 {
+	return float64(p) + 12
+}
+
+// Name of the nearest note, with the cents off it if any, like "C4+25c".
+func (p Pitch) String() string {
+	note := Note(math.Round(float64(p)))
+	cents := math.Round((float64(p) - float64(note)) * 100)
+	if cents == 0 {
+		return note.String()
+	}
+	return fmt.Sprintf("%v%+gc", note, cents)
+}
+
+// Pitches of MIDI notes 0 and 127, the lowest and highest accepted.
+var (
+	minPitch = MIDIPitch(0)
+	maxPitch = MIDIPitch(127)
+)
+
+// The pitch, unless out of the MIDI range or not a number.
+func CheckPitch(p Pitch) (Pitch, error) {
+	if math.IsNaN(float64(p)) || p < minPitch || p > maxPitch {
+		return 0, fmt.Errorf("pitch %g out of the MIDI range", p.MIDI())
+	}
+	return p, nil
+}
+
+var centsPattern = regexp.MustCompile(`^(.+?)([+-][0-9]+(?:\.[0-9]+)?)c$`)
+
+// Pitch from a note name with cents off it like "c4+25c" or "eb3-13.7c", a
+// frequency like "432hz", or a MIDI note number like "60.5", within the MIDI
+// range.
+func NewPitch(s string) (Pitch, error) {
+	if lower := strings.ToLower(s); strings.HasSuffix(lower, "hz") {
+		hz, err := strconv.ParseFloat(strings.TrimSuffix(lower, "hz"), 64)
+		if err != nil || hz <= 0 {
+			return 0, fmt.Errorf("invalid frequency %q", s)
+		}
+		return CheckPitch(FrequencyPitch(hz))
+	}
+	if midi, err := strconv.ParseFloat(s, 64); err == nil {
+		return CheckPitch(MIDIPitch(midi))
+	}
+	name, cents := s, 0.0
+	if match := centsPattern.FindStringSubmatch(s); match != nil {
+		name = match[1]
+		cents, _ = strconv.ParseFloat(match[2], 64)
+	}
+	note, err := NewNote(name)
+	if err != nil {
+		return 0, err
+	}
+	return CheckPitch(Pitch(float64(note) + cents/100))
+}
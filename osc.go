@@ -4,14 +4,49 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/hypebeast/go-osc/osc"
 )
 
 var (
-	oscAddr = flag.String("osc-addr", "127.0.0.1:8765", "UDP IP:port to listen for OSC messages")
+	oscAddr      = flag.String("osc-addr", "127.0.0.1:8765", "UDP IP:port to listen for OSC messages")
+	cueAddr      = flag.String("cue-addr", "", "UDP IP:port to send OSC cues about selected keys and pads to, e.g. 127.0.0.1:4560 for Sonic Pi")
+	cueNotesPath = flag.String("cue-notes-path", "/trosces/selected", "OSC address for cues of selected keyboard notes")
+	cueDrumsPath = flag.String("cue-drums-path", "/trosces/selected_drums", "OSC address for cues of selected drum instruments")
 )
 
+// Sends OSC messages back to the live-coding host.
+type Cue struct {
+	client *osc.Client
+}
+
+func NewCue(addr string) (*Cue, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	return &Cue{client: osc.NewClient(host, port)}, nil
+}
+
+func (cue *Cue) Send(path string, args []string) {
+	msg := osc.NewMessage(path)
+	for _, arg := range args {
+		msg.Append(arg)
+	}
+	go func() {
+		if err := cue.client.Send(msg); err != nil {
+			log.Printf("Failed to send %s cue: %v", path, err)
+		}
+	}()
+}
+
 func CheckArgs(args []interface{}, min int, max int) error {
 	if len(args) < min || len(args) > max {
 		return fmt.Errorf("expected %d to %d arguments, got: %d", min, max, len(args))
@@ -27,15 +62,15 @@ func NameArg(arg interface{}) (string, error) {
 	}
 }
 
-func NoteArg(arg interface{}) (Note, error) {
-	if name, err := NameArg(arg); err != nil {
-		return 0, err
+// Note name as for NewPitch, or the MIDI note number.
+func PitchArg(arg interface{}) (Pitch, error) {
+	if name, err := NameArg(arg); err == nil {
+		return NewPitch(name)
+	}
+	if midi, err := FloatArg(arg); err != nil {
+		return 0, fmt.Errorf("neither a string nor a number")
 	} else {
-		if note, err := NewNote(name); err != nil {
-			return 0, err
-		} else {
-			return note, nil
-		}
+		return CheckPitch(MIDIPitch(float64(midi)))
 	}
 }
 
@@ -47,133 +82,175 @@ func NumberArg(arg interface{}) (int, error) {
 	}
 }
 
-func DurationArg(arg interface{}) (Duration, error) {
+func FloatArg(arg interface{}) (float32, error) {
 	if f32, ok := arg.(float32); !ok {
 		if f64, ok := arg.(float64); !ok {
 			if i, err := NumberArg(arg); err != nil {
-				return Beats(0), fmt.Errorf("not a number")
+				return 0, fmt.Errorf("not a number")
 			} else {
-				return Beats(float32(i)), nil
+				return float32(i), nil
 			}
 		} else {
-			return Beats(float32(f64)), nil
+			return float32(f64), nil
 		}
 	} else {
-		return Beats(f32), nil
+		return f32, nil
+	}
+}
+
+// Longest duration accepted, in beats.
+const maxDurationBeats = 1e6
+
+func DurationArg(arg interface{}) (Duration, error) {
+	if beats, err := FloatArg(arg); err != nil {
+		return Beats(0), err
+	} else if !(beats >= 0 && beats <= maxDurationBeats) {
+		return Beats(0), fmt.Errorf("not within 0..%g beats", float64(maxDurationBeats))
+	} else {
+		return Beats(beats), nil
+	}
+}
+
+func VelocityArg(arg interface{}) (float32, error) {
+	if velocity, err := FloatArg(arg); err != nil {
+		return 0, err
+	} else if velocity < 0 || velocity > 1 {
+		return 0, fmt.Errorf("not within 0..1")
+	} else {
+		return velocity, nil
 	}
 }
 
 func LaunchOSCServer(trosces *Trosces) {
-	d := osc.NewStandardDispatcher()
+	d := newCountingDispatcher()
 
 	d.AddMsgHandler("/play", func(msg *osc.Message) {
+		received := time.Now()
 		var err error
-		if err = CheckArgs(msg.Arguments, 2, 3); err != nil {
-			log.Printf("Invalid /play: %v", err)
+		if err = CheckArgs(msg.Arguments, 2, 4); err != nil {
+			invalid("/play", "Invalid /play: %v", err)
 			return
 		}
 
 		var (
 			instrument string
-			note       Note
+			note       Pitch
 			duration   Duration
+			velocity   float32 = 1
 		)
 
 		if instrument, err = NameArg(msg.Arguments[0]); err != nil {
-			log.Printf("Invalid /play[0] instrument: %v", err)
+			invalid("/play", "Invalid /play[0] instrument: %v", err)
 			return
 		}
 
-		if note, err = NoteArg(msg.Arguments[1]); err != nil {
-			log.Printf("Invalid /play[1] note: %v", err)
+		if note, err = PitchArg(msg.Arguments[1]); err != nil {
+			invalid("/play", "Invalid /play[1] note: %v", err)
 			return
 		}
 
-		if len(msg.Arguments) == 3 {
+		if len(msg.Arguments) >= 3 {
 			if duration, err = DurationArg(msg.Arguments[2]); err != nil {
-				log.Printf("Invalid /play[2] duration: %v", err)
+				invalid("/play", "Invalid /play[2] duration: %v", err)
+				return
+			}
+		}
+
+		if len(msg.Arguments) == 4 {
+			if velocity, err = VelocityArg(msg.Arguments[3]); err != nil {
+				invalid("/play", "Invalid /play[3] velocity: %v", err)
 				return
 			}
 		}
 
-		trosces.PlayNote(instrument, note, duration)
+		trosces.bus.Publish(&PlayEvent{Instrument: instrument, Note: note, Duration: duration, Velocity: velocity, At: received})
 	})
 
 	d.AddMsgHandler("/stop", func(msg *osc.Message) {
+		received := time.Now()
 		var err error
 		if err = CheckArgs(msg.Arguments, 2, 2); err != nil {
-			log.Printf("Invalid /stop: %v", err)
+			invalid("/stop", "Invalid /stop: %v", err)
 			return
 		}
 
 		var (
 			instrument string
-			note       Note
+			note       Pitch
 		)
 
 		if instrument, err = NameArg(msg.Arguments[0]); err != nil {
-			log.Printf("Invalid /stop[0] instrument: %v", err)
+			invalid("/stop", "Invalid /stop[0] instrument: %v", err)
 			return
 		}
 
-		if note, err = NoteArg(msg.Arguments[1]); err != nil {
-			log.Printf("Invalid /stop[1] note: %v", err)
+		if note, err = PitchArg(msg.Arguments[1]); err != nil {
+			invalid("/stop", "Invalid /stop[1] note: %v", err)
 			return
 		}
 
-		trosces.StopNote(instrument, note)
+		trosces.bus.Publish(&StopEvent{Instrument: instrument, Note: note, At: received})
 	})
 
 	d.AddMsgHandler("/highlight", func(msg *osc.Message) {
-		var notes []int
+		var notes []Pitch
 		for i, arg := range msg.Arguments {
-			if note, err := NoteArg(arg); err != nil {
-				log.Printf("Invalid /highlight[%d] note: %v", i, err)
+			if note, err := PitchArg(arg); err != nil {
+				invalid("/highlight", "Invalid /highlight[%d] note: %v", i, err)
 				return
 			} else {
-				notes = append(notes, int(note))
+				notes = append(notes, note)
 			}
 		}
 
-		trosces.SetHighlight(notes)
+		trosces.bus.Publish(&HighlightEvent{Notes: notes})
 	})
 
 	d.AddMsgHandler("/drum", func(msg *osc.Message) {
+		received := time.Now()
 		var err error
-		if err = CheckArgs(msg.Arguments, 1, 2); err != nil {
-			log.Printf("Invalid /drum: %v", err)
+		if err = CheckArgs(msg.Arguments, 1, 3); err != nil {
+			invalid("/drum", "Invalid /drum: %v", err)
 			return
 		}
 
 		var (
 			instrument string
 			duration   Duration
+			velocity   float32 = 1
 		)
 
 		if instrument, err = NameArg(msg.Arguments[0]); err != nil {
-			log.Printf("Invalid /drum[0] instrument: %v", err)
+			invalid("/drum", "Invalid /drum[0] instrument: %v", err)
 			return
 		}
 
-		if len(msg.Arguments) == 2 {
+		if len(msg.Arguments) >= 2 {
 			if duration, err = DurationArg(msg.Arguments[1]); err != nil {
-				log.Printf("Invalid /drum[1] duration: %v", err)
+				invalid("/drum", "Invalid /drum[1] duration: %v", err)
 				return
 			}
 		}
 
-		trosces.PlayDrum(instrument, duration)
+		if len(msg.Arguments) == 3 {
+			if velocity, err = VelocityArg(msg.Arguments[2]); err != nil {
+				invalid("/drum", "Invalid /drum[2] velocity: %v", err)
+				return
+			}
+		}
+
+		trosces.bus.Publish(&DrumEvent{Instrument: instrument, Duration: duration, Velocity: velocity, At: received})
 	})
 
 	d.AddMsgHandler("/automation", func(msg *osc.Message) {
-		// TODO: plot automation values
-		log.Printf("/automation unimplemented")
+		trosces.bus.Publish(&AutomationEvent{Arguments: msg.Arguments})
 	})
 
 	d.AddMsgHandler("/layer", func(msg *osc.Message) {
+		received := time.Now()
 		var err error
 		if err = CheckArgs(msg.Arguments, 2, 3); err != nil {
-			log.Printf("Invalid /layer: %v", err)
+			invalid("/layer", "Invalid /layer: %v", err)
 			return
 		}
 
@@ -184,42 +261,153 @@ func LaunchOSCServer(trosces *Trosces) {
 		)
 
 		if name, err = NameArg(msg.Arguments[0]); err != nil {
-			log.Printf("Invalid /layer[0] name: %v", err)
+			invalid("/layer", "Invalid /layer[0] name: %v", err)
 			return
 		}
 
 		if duration, err = DurationArg(msg.Arguments[1]); err != nil {
-			log.Printf("Invalid /layer[1] duration: %v", err)
+			invalid("/layer", "Invalid /layer[1] duration: %v", err)
 			return
 		}
 
 		if len(msg.Arguments) == 3 {
 			if variant, err = NameArg(msg.Arguments[2]); err != nil {
-				log.Printf("Invalid /layer[2] variant: %v", err)
+				invalid("/layer", "Invalid /layer[2] variant: %v", err)
 				return
 			}
 		}
 
-		trosces.PlayLayer(name, duration, variant)
+		trosces.bus.Publish(&LayerEvent{Name: name, Duration: duration, Variant: variant, At: received})
 	})
 
 	d.AddMsgHandler("/sync", func(msg *osc.Message) {
+		received := time.Now()
 		var err error
 		if err = CheckArgs(msg.Arguments, 1, 1); err != nil {
-			log.Printf("Invalid /sync: %v", err)
+			invalid("/sync", "Invalid /sync: %v", err)
 			return
 		}
 
 		var bpm int
 
 		if bpm, err = NumberArg(msg.Arguments[0]); err != nil {
-			log.Printf("Invalid /sync[0] bpm: %v", err)
+			invalid("/sync", "Invalid /sync[0] bpm: %v", err)
 			return
 		}
 
-		trosces.Sync(bpm)
+		trosces.bus.Publish(&SyncEvent{Bpm: bpm, At: received})
 	})
 
+	d.AddMsgHandler("/range", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 1, 2); err != nil {
+			invalid("/range", "Invalid /range: %v", err)
+			return
+		}
+
+		event := &RangeEvent{}
+
+		if len(msg.Arguments) == 1 {
+			var policy string
+			if policy, err = NameArg(msg.Arguments[0]); err == nil {
+				switch policy {
+				case "grow":
+					event.Policy = RangeGrow
+				case "shrink":
+					event.Policy = RangeShrink
+				default:
+					err = fmt.Errorf("expected grow or shrink, got %q", policy)
+				}
+			}
+			if err != nil {
+				invalid("/range", "Invalid /range[0] policy: %v", err)
+				return
+			}
+		} else {
+			event.Policy = RangeFixed
+			if event.Low, err = PitchArg(msg.Arguments[0]); err != nil {
+				invalid("/range", "Invalid /range[0] low note: %v", err)
+				return
+			}
+			if event.High, err = PitchArg(msg.Arguments[1]); err != nil {
+				invalid("/range", "Invalid /range[1] high note: %v", err)
+				return
+			}
+			if event.High < event.Low {
+				invalid("/range", "Invalid /range[1] high note: below the low note")
+				return
+			}
+		}
+
+		trosces.bus.Publish(event)
+	})
+
+	d.AddMsgHandler("/instrument", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 1, 5); err != nil {
+			invalid("/instrument", "Invalid /instrument: %v", err)
+			return
+		}
+
+		event := &InstrumentEvent{Track: "keyboard", Order: -1}
+
+		if event.Name, err = NameArg(msg.Arguments[0]); err != nil {
+			invalid("/instrument", "Invalid /instrument[0] name: %v", err)
+			return
+		}
+
+		if len(msg.Arguments) >= 2 {
+			var hex string
+			if hex, err = NameArg(msg.Arguments[1]); err == nil && hex != "" {
+				event.Color, err = parseHexColor(hex)
+			}
+			if err != nil {
+				invalid("/instrument", "Invalid /instrument[1] color: %v", err)
+				return
+			}
+		}
+
+		if len(msg.Arguments) >= 3 {
+			if event.Label, err = NameArg(msg.Arguments[2]); err != nil {
+				invalid("/instrument", "Invalid /instrument[2] label: %v", err)
+				return
+			}
+		}
+
+		if len(msg.Arguments) >= 4 {
+			var track string
+			if track, err = NameArg(msg.Arguments[3]); err == nil && !isTrackName(track) {
+				err = fmt.Errorf("unknown track %q", track)
+			}
+			if err != nil {
+				invalid("/instrument", "Invalid /instrument[3] track: %v", err)
+				return
+			}
+			event.Track = track
+		}
+		if event.Color != nil && event.Track == "layers" {
+			invalid("/instrument", "Invalid /instrument[1] color: layers are colored by variant")
+			return
+		}
+
+		if len(msg.Arguments) == 5 {
+			if event.Order, err = NumberArg(msg.Arguments[4]); err == nil && event.Order < 0 {
+				err = fmt.Errorf("negative")
+			}
+			if err != nil {
+				invalid("/instrument", "Invalid /instrument[4] order: %v", err)
+				return
+			}
+		}
+
+		trosces.bus.Publish(event)
+	})
+
+	addControlHandlers(d, trosces)
+	addVisibilityHandlers(d, trosces)
+	addColorHandlers(d, trosces)
+	addThemeHandlers(d, trosces)
+
 	server := &osc.Server{
 		Addr:       *oscAddr,
 		Dispatcher: d,
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+
+	"github.com/hypebeast/go-osc/osc"
+)
+
+// Fill drawn over the color, for telling instruments apart beyond the hue.
+type Pattern int
+
+const (
+	Solid Pattern = iota
+	Stripes
+	Dots
+	patternCount
+)
+
+const (
+	// Pixels between the stripes or dots, lining up across buckets of
+	// whole multiples of it
+	patternPeriod = 8
+	// Darkening drawn over the color
+	patternAlpha = 0x50
+)
+
+// Color of the instrument: from the palette while it lasts, then generated.
+func spanColor(id int) color.Color {
+	if id < len(spanPalette) {
+		return spanPalette[id]
+	}
+	return generatedColor(id - len(spanPalette))
+}
+
+// Plain for the first round of the palette, then patterned too.
+func spanPattern(id int) Pattern {
+	return Pattern(id / len(spanPalette) % int(patternCount))
+}
+
+// Colors spread around the hue circle by the golden angle, alternating the
+// lightness, so that each one is far from those before it.
+func generatedColor(n int) color.Color {
+	lightness := []float64{0.72, 0.58, 0.84}[n%3]
+	hue := 25 + float64(n)*137.508
+	// Less saturated until it fits in sRGB
+	for chroma := 0.14; chroma > 0; chroma -= 0.01 {
+		if c, ok := oklch(lightness, chroma, hue); ok {
+			return c
+		}
+	}
+	c, _ := oklch(lightness, 0, hue)
+	return c
+}
+
+// sRGB color of the OKLCH coordinates, hue in degrees. Not ok if out of
+// gamut.
+func oklch(l, c, h float64) (color.RGBA, bool) {
+	a := c * math.Cos(h*math.Pi/180)
+	b := c * math.Sin(h*math.Pi/180)
+
+	lc := math.Pow(l+0.3963377774*a+0.2158037573*b, 3)
+	mc := math.Pow(l-0.1055613458*a-0.0638541728*b, 3)
+	sc := math.Pow(l-0.0894841775*a-1.2914855480*b, 3)
+
+	linear := []float64{
+		4.0767416621*lc - 3.3077115913*mc + 0.2309699292*sc,
+		-1.2684380046*lc + 2.6097574011*mc - 0.3413193965*sc,
+		-0.0041960863*lc - 0.7034186147*mc + 1.7076147010*sc,
+	}
+	var rgb [3]uint8
+	ok := true
+	for i, v := range linear {
+		if v < -1e-4 || v > 1+1e-4 {
+			ok = false
+		}
+		v = math.Max(0, math.Min(1, v))
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		rgb[i] = uint8(math.Round(v * 255))
+	}
+	return color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}, ok
+}
+
+// Color written as "#rrggbb", or "#rrggbbaa" with (not premultiplied) alpha.
+func parseHexColor(s string) (color.Color, error) {
+	var r, g, b uint8
+	a := uint8(0xff)
+	var err error
+	switch len(s) {
+	case 7:
+		_, err = fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b)
+	case 9:
+		_, err = fmt.Sscanf(s, "#%02x%02x%02x%02x", &r, &g, &b, &a)
+	default:
+		err = fmt.Errorf("wrong length")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expected #rrggbb or #rrggbbaa, got %q", s)
+	}
+	if a == 0xff {
+		return color.RGBA{r, g, b, a}, nil
+	}
+	return color.NRGBA{r, g, b, a}, nil
+}
+
+type point struct {
+	x, y float32
+}
+
+// Part of the convex polygon where a*x+b*y <= c.
+func clipPolygon(polygon []point, a, b, c float32) []point {
+	var clipped []point
+	inside := func(p point) bool { return a*p.x+b*p.y <= c }
+	for i, p := range polygon {
+		q := polygon[(i+1)%len(polygon)]
+		if inside(p) {
+			clipped = append(clipped, p)
+		}
+		if inside(p) != inside(q) {
+			t := (c - a*p.x - b*p.y) / (a*(q.x-p.x) + b*(q.y-p.y))
+			clipped = append(clipped, point{p.x + t*(q.x-p.x), p.y + t*(q.y-p.y)})
+		}
+	}
+	return clipped
+}
+
+// Pinned color of the instrument on the track, or the palette one.
+func (trail *Trail) SpanColor(id int) color.Color {
+	if c, ok := trail.colors[id]; ok {
+		return c
+	}
+	return spanColor(id)
+}
+
+// Pinned instruments are drawn plain.
+func (trail *Trail) SpanPattern(id int) Pattern {
+	if _, ok := trail.colors[id]; ok {
+		return Solid
+	}
+	return spanPattern(id)
+}
+
+// Use the colors for the instruments instead of the palette.
+func (trail *Trail) SetColors(pinned map[int]color.Color) {
+	trail.colors = pinned
+	trail.redrawAll()
+}
+
+// Copy of the pinned colors of the track, for a trail.
+func (trosces *Trosces) pinnedColors(track string) map[int]color.Color {
+	pinned := make(map[int]color.Color, len(trosces.pinned[track]))
+	for id, c := range trosces.pinned[track] {
+		pinned[id] = c
+	}
+	return pinned
+}
+
+func (trosces *Trosces) applyColors(track string) {
+	tracks, _ := trosces.namedTracks(track)
+	for _, t := range tracks {
+		t.trail.SetColors(trosces.pinnedColors(track))
+	}
+}
+
+// Pin the color of the instrument, or unpin it if nil.
+func (trosces *Trosces) PinColor(track string, id int, c color.Color) {
+	if c == nil {
+		delete(trosces.pinned[track], id)
+	} else {
+		trosces.pinned[track][id] = c
+	}
+	trosces.pinnedVersion++
+	trosces.applyColors(track)
+}
+
+func addColorHandlers(d *countingDispatcher, trosces *Trosces) {
+	d.AddMsgHandler("/trosces/color", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 2, 3); err != nil {
+			invalid("/trosces/color", "Invalid /trosces/color: %v", err)
+			return
+		}
+
+		var track, name string
+		var c color.Color
+
+		if track, err = NameArg(msg.Arguments[0]); err != nil {
+			invalid("/trosces/color", "Invalid /trosces/color[0] track: %v", err)
+			return
+		}
+		if _, ok := trosces.pinned[track]; !ok {
+			invalid("/trosces/color", "Invalid /trosces/color[0] track: no instruments in %q", track)
+			return
+		}
+		if name, err = NameArg(msg.Arguments[1]); err != nil {
+			invalid("/trosces/color", "Invalid /trosces/color[1] instrument: %v", err)
+			return
+		}
+		if len(msg.Arguments) == 3 {
+			var hex string
+			if hex, err = NameArg(msg.Arguments[2]); err == nil {
+				c, err = parseHexColor(hex)
+			}
+			if err != nil {
+				invalid("/trosces/color", "Invalid /trosces/color[2] color: %v", err)
+				return
+			}
+		}
+
+		trosces.Do(func() {
+			tracks, _ := trosces.namedTracks(track)
+			id, ok := tracks[0].mapper.Id(name)
+			if !ok {
+				invalid("/trosces/color", "Invalid /trosces/color[1] instrument: no %q in %q", name, track)
+				return
+			}
+			trosces.PinColor(track, id, c)
+		})
+	})
+}
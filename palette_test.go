@@ -0,0 +1,38 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestGeneratedColors(t *testing.T) {
+	var seen []color.Color
+	for id := 0; id < 40; id++ {
+		c := spanColor(id)
+		r, g, b, _ := c.RGBA()
+		for _, other := range seen {
+			or, og, ob, _ := other.RGBA()
+			if r == or && g == og && b == ob {
+				t.Errorf("instrument %d has the same color %s as an earlier one", id, hexColor(c))
+			}
+		}
+		seen = append(seen, c)
+	}
+
+	if got := spanPattern(0); got != Solid {
+		t.Errorf("first instrument should be plain, got pattern %d", got)
+	}
+	if got := spanPattern(len(spanPalette)); got != Stripes {
+		t.Errorf("first generated color should be striped, got pattern %d", got)
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	c, err := parseHexColor("#4477aa")
+	if err != nil || c != (color.RGBA{0x44, 0x77, 0xaa, 0xff}) {
+		t.Errorf("got %v, %v, want #4477aa", c, err)
+	}
+	if _, err := parseHexColor("blue"); err == nil {
+		t.Errorf("want an error for a color name")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	keyboardRange = flag.String("range", "grow", "Range of the keyboard: \"grow\" by octaves to fit the notes, also \"shrink\" once they have scrolled off, or fixed like \"C2:B5\"")
+)
+
+// How the range of positions shown follows the spans.
+type RangePolicy int
+
+const (
+	// Widened to fit every new position, rounded out to whole steps of the
+	// trail's alignment
+	RangeGrow RangePolicy = iota
+	// As above, and narrowed back once positions have scrolled off
+	RangeShrink
+	// Set by hand, positions outside are not drawn
+	RangeFixed
+)
+
+// Policy and fixed range, if any, from "grow", "shrink" or "<low>:<high>".
+func ParseRange(s string) (RangePolicy, Pitch, Pitch, error) {
+	switch s {
+	case "grow":
+		return RangeGrow, 0, 0, nil
+	case "shrink":
+		return RangeShrink, 0, 0, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, 0, fmt.Errorf("expected grow, shrink or <low>:<high>, got %q", s)
+	}
+	low, err := NewPitch(parts[0])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid low note %q: %v", parts[0], err)
+	}
+	high, err := NewPitch(parts[1])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid high note %q: %v", parts[1], err)
+	}
+	if high < low {
+		return 0, 0, 0, fmt.Errorf("high note %v below low note %v", high, low)
+	}
+	return RangeFixed, low, high, nil
+}
+
+// Follow the policy from now on, with the range for a fixed one.
+func (trail *Trail) SetRangePolicy(policy RangePolicy, min int, max int) {
+	trail.rangePolicy = policy
+	if policy == RangeFixed {
+		trail.setRange(min, max)
+		return
+	}
+	// Fit what there is so far
+	spans := trail.spans.All()
+	if len(spans) == 0 {
+		return
+	}
+	min, max = spans[0].pos, spans[0].pos
+	for _, span := range spans {
+		if span.pos < min {
+			min = span.pos
+		}
+		if span.pos > max {
+			max = span.pos
+		}
+	}
+	trail.setRange(trail.alignRange(min, max))
+}
+
+// Make room for a new span at the position.
+func (trail *Trail) fitRange(pos int) {
+	if trail.rangePolicy == RangeFixed {
+		return
+	}
+	min, max := trail.alignRange(pos, pos)
+	if trail.spans.Len() == 0 {
+		// Start over from the first span
+		trail.minPos = min
+		trail.maxPos = max
+		trail.resetAll()
+		trail.updateColumns()
+		return
+	}
+	if trail.minPos < min {
+		min = trail.minPos
+	}
+	if trail.maxPos > max {
+		max = trail.maxPos
+	}
+	trail.setRange(min, max)
+}
+
+// Narrow the range to the positions still shown, if it shrinks.
+func (trail *Trail) shrinkRange() {
+	if trail.rangePolicy != RangeShrink {
+		return
+	}
+	shown := trail.length
+	if trail.cycleView {
+		shown = Beats(trail.cycle.Beats() * float32(trail.cycles))
+	}
+	now := trail.pulse.Horizon()
+	spans := trail.Spans(now.Sub(shown), now)
+	if len(spans) == 0 {
+		return
+	}
+	min, max := spans[0].pos, spans[0].pos
+	for _, span := range spans {
+		if span.pos < min {
+			min = span.pos
+		}
+		if span.pos > max {
+			max = span.pos
+		}
+	}
+	min, max = trail.alignRange(min, max)
+	if min > trail.minPos || max < trail.maxPos {
+		trail.setRange(min, max)
+	}
+}
+
+// Rounded out to whole steps of the alignment, e.g. octaves.
+func (trail *Trail) alignRange(min int, max int) (int, int) {
+	align := trail.rangeAlign
+	if align <= 1 {
+		return min, max
+	}
+	// From the start of a repeat of the tuning, like C
+	origin := trail.tuning.middle
+	return origin + floorDiv(min-origin, align)*align, origin + floorDiv(max-origin, align)*align + align - 1
+}
+
+func (trail *Trail) setRange(min int, max int) {
+	if trail.minPos != min || trail.maxPos != max {
+		trail.minPos = min
+		trail.maxPos = max
+		trail.updateColumns()
+	}
+}
+
+// Whether the position has a column, within the range and, if compact,
+// played.
+func (trail *Trail) inRange(pos int) bool {
+	_, ok := trail.columns.Of(pos)
+	return ok
+}
+
+// Set the range policy of all the keyboard tracks, fixed to the keys nearest
+// to the pitches.
+func (trosces *Trosces) SetKeyboardRange(policy RangePolicy, low Pitch, high Pitch) {
+	trosces.rangePolicy = policy
+	trosces.rangeLow = low
+	trosces.rangeHigh = high
+	lowKey, _ := trosces.tuning.Key(low)
+	highKey, _ := trosces.tuning.Key(high)
+	tracks, _ := trosces.namedTracks("keyboard")
+	for _, track := range tracks {
+		track.trail.SetRangePolicy(policy, lowKey, highKey)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRangePolicies(t *testing.T) {
+	trail := NewTrail(Beats(1), Beats(4), 192, 15)
+	trail.pulse = NewPulse(60)
+	trail.rangeAlign = 12
+
+	checkRange := func(name string, wantMin, wantMax int) {
+		t.Helper()
+		if min, max := trail.Range(); min != wantMin || max != wantMax {
+			t.Errorf("%s: got range %d..%d, want %d..%d", name, min, max, wantMin, wantMax)
+		}
+	}
+
+	trail.Span(0, 62, Forever())
+	checkRange("first note", 60, 71)
+	trail.Span(0, 64, Beats(1))
+	checkRange("same octave", 60, 71)
+	trail.Span(0, 50, Beats(1))
+	checkRange("lower octave", 48, 71)
+
+	// Only the held note is left once the others have scrolled off
+	trail.SetRangePolicy(RangeShrink, 0, 0)
+	trail.pulse.frozen = OnBeat(100)
+	trail.shrinkRange()
+	checkRange("shrunk", 60, 71)
+
+	trail.SetRangePolicy(RangeFixed, 36, 47)
+	trail.Span(0, 62, Beats(1))
+	checkRange("fixed", 36, 47)
+	if spans := trail.VisibleSpans(OnBeat(0), OnBeat(200)); len(spans) != 0 {
+		t.Errorf("got %d spans out of the fixed range, want none", len(spans))
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	policy, low, high, err := ParseRange("C2:B5")
+	if err != nil || policy != RangeFixed || low.String() != "C2" || high.String() != "B5" {
+		t.Errorf("got %v %v..%v, %v, want fixed C2..B5", policy, low, high, err)
+	}
+	if policy, _, _, err := ParseRange("shrink"); err != nil || policy != RangeShrink {
+		t.Errorf("got %v, %v, want shrink", policy, err)
+	}
+	if _, _, _, err := ParseRange("B5:C2"); err == nil {
+		t.Errorf("want an error for a reversed range")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	registryPath  = flag.String("registry", defaultRegistryPath(), "JSON file to keep instrument IDs, colors, display names and pad order in across restarts, none if empty")
+	resetRegistry = flag.Bool("reset-registry", false, "Start with no instruments known, overwriting the -registry file")
+)
+
+func defaultRegistryPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "trosces", "registry.json")
+}
+
+// Instruments of each track as saved, editable by hand.
+type RegistryFile struct {
+	Keyboard []RegistryEntry `json:"keyboard"`
+	Drums    []RegistryEntry `json:"drums"`
+	Layers   []RegistryEntry `json:"layers"`
+	// Variants by layer name
+	Variants map[string][]RegistryEntry `json:"variants,omitempty"`
+}
+
+type RegistryEntry struct {
+	Name string `json:"name"`
+	Id   int    `json:"id"`
+	// Pad or layer column, or order of the split keyboard tracks
+	Pos int `json:"pos"`
+	// Shown instead of the name
+	Label string `json:"label,omitempty"`
+	// Pinned color
+	Color *HexColor `json:"color,omitempty"`
+}
+
+// Saves the instruments whenever they change, off the game loop.
+type Registry struct {
+	path  string
+	saves chan []byte
+	done  chan struct{}
+	// Mapper versions last saved
+	saved int
+}
+
+func NewRegistry(path string) *Registry {
+	registry := &Registry{
+		path:  path,
+		saves: make(chan []byte, 1),
+		done:  make(chan struct{}),
+		saved: -1,
+	}
+	go func() {
+		defer close(registry.done)
+		for data := range registry.saves {
+			if err := registry.write(data); err != nil {
+				log.Printf("Could not save the registry: %v", err)
+			}
+		}
+	}()
+	return registry
+}
+
+func (registry *Registry) Load() (*RegistryFile, error) {
+	data, err := ioutil.ReadFile(registry.path)
+	if os.IsNotExist(err) {
+		return &RegistryFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var file RegistryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for name, entries := range map[string][]RegistryEntry{
+		"keyboard": file.Keyboard,
+		"drums":    file.Drums,
+		"layers":   file.Layers,
+	} {
+		if err := checkEntries(entries); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	for layer, entries := range file.Variants {
+		if err := checkEntries(entries); err != nil {
+			return nil, fmt.Errorf("variants of %s: %v", layer, err)
+		}
+	}
+	return &file, nil
+}
+
+func checkEntries(entries []RegistryEntry) error {
+	names := map[string]bool{}
+	ids := map[int]bool{}
+	positions := map[int]bool{}
+	for _, entry := range entries {
+		switch {
+		case entry.Id < 0 || entry.Pos < 0:
+			return fmt.Errorf("negative id or pos of %q", entry.Name)
+		case entry.Pos >= len(entries):
+			return fmt.Errorf("pos %d of %q past the %d entries", entry.Pos, entry.Name, len(entries))
+		case names[entry.Name]:
+			return fmt.Errorf("%q listed twice", entry.Name)
+		case ids[entry.Id]:
+			return fmt.Errorf("id %d of %q already taken", entry.Id, entry.Name)
+		case positions[entry.Pos]:
+			return fmt.Errorf("pos %d of %q already taken", entry.Pos, entry.Name)
+		}
+		names[entry.Name] = true
+		ids[entry.Id] = true
+		positions[entry.Pos] = true
+	}
+	return nil
+}
+
+// Queue the file to be written, replacing any not written yet.
+func (registry *Registry) Save(data []byte) {
+	for {
+		select {
+		case registry.saves <- data:
+			return
+		default:
+		}
+		select {
+		case <-registry.saves:
+		default:
+		}
+	}
+}
+
+func (registry *Registry) write(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(registry.path), 0755); err != nil {
+		return err
+	}
+	// Replaced in one go, so never left half written
+	tmp := registry.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, registry.path)
+}
+
+// Wait for the last save to be written.
+func (registry *Registry) Close() {
+	close(registry.saves)
+	<-registry.done
+}
+
+// Save the instruments a last time before exiting.
+func (trosces *Trosces) Close() {
+	if trosces.registry == nil {
+		return
+	}
+	trosces.saveRegistry()
+	trosces.registry.Close()
+}
+
+// Assign the saved IDs and colors before any input arrives.
+func (trosces *Trosces) loadRegistry() {
+	if *registryPath == "" {
+		return
+	}
+	trosces.registry = NewRegistry(*registryPath)
+	if *resetRegistry {
+		log.Printf("Starting with a fresh registry in %s", *registryPath)
+		return
+	}
+	file, err := trosces.registry.Load()
+	if err != nil {
+		log.Fatalf("Invalid -registry file %s, fix it or start afresh with -reset-registry: %v", *registryPath, err)
+	}
+
+	restore := func(mapper *Mapper, entries []RegistryEntry, pinned map[int]color.Color) {
+		for _, entry := range entries {
+			mapper.Set(entry.Name, entry.Id, entry.Pos, entry.Label)
+			if entry.Color != nil && pinned != nil {
+				pinned[entry.Id] = *entry.Color
+			}
+		}
+	}
+	restore(trosces.keyboard.mapper, file.Keyboard, trosces.pinned["keyboard"])
+	restore(trosces.drums.mapper, file.Drums, trosces.pinned["drums"])
+	restore(trosces.layers.mapper, file.Layers, nil)
+	for layer, entries := range file.Variants {
+		restore(trosces.variantMapper(trosces.layers.mapper.Get(layer)), entries, nil)
+	}
+	trosces.applyColors("keyboard")
+	trosces.applyColors("drums")
+	log.Printf("Loaded %d instruments and %d drums from %s", len(file.Keyboard), len(file.Drums), *registryPath)
+	trosces.registry.saved = trosces.registryVersion()
+}
+
+// Changes to the instruments so far.
+func (trosces *Trosces) registryVersion() int {
+	version := trosces.keyboard.mapper.version + trosces.drums.mapper.version + trosces.layers.mapper.version
+	for _, mapper := range trosces.variantMappers {
+		version += mapper.version
+	}
+	return version + trosces.pinnedVersion
+}
+
+// Save the instruments if changed since last time.
+func (trosces *Trosces) saveRegistry() {
+	if trosces.registry == nil {
+		return
+	}
+	version := trosces.registryVersion()
+	if version == trosces.registry.saved {
+		return
+	}
+	trosces.registry.saved = version
+
+	entries := func(mapper *Mapper, pinned map[int]color.Color) []RegistryEntry {
+		var entries []RegistryEntry
+		for name, id := range mapper.Ids() {
+			entry := RegistryEntry{
+				Name:  name,
+				Id:    id,
+				Pos:   mapper.Pos(id),
+				Label: mapper.labels[id],
+			}
+			if c, ok := pinned[id]; ok {
+				hex := HexColor(color.NRGBAModel.Convert(c).(color.NRGBA))
+				entry.Color = &hex
+			}
+			entries = append(entries, entry)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Id < entries[j].Id })
+		return entries
+	}
+	file := &RegistryFile{
+		Keyboard: entries(trosces.keyboard.mapper, trosces.pinned["keyboard"]),
+		Drums:    entries(trosces.drums.mapper, trosces.pinned["drums"]),
+		Layers:   entries(trosces.layers.mapper, nil),
+		Variants: map[string][]RegistryEntry{},
+	}
+	for name, lNum := range trosces.layers.mapper.Ids() {
+		if mapper, ok := trosces.variantMappers[lNum]; ok {
+			file.Variants[name] = entries(mapper, nil)
+		}
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		log.Printf("Could not encode the registry: %v", err)
+		return
+	}
+	trosces.registry.Save(data)
+}
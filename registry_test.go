@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMapperRestore(t *testing.T) {
+	mapper := NewMapper()
+	mapper.Set("snare", 1, 0, "Snare")
+	mapper.Set("kick", 0, 2, "")
+
+	if got := mapper.Get("kick"); got != 0 {
+		t.Errorf("got kick id %d, want the saved 0", got)
+	}
+	if got := mapper.Label(1); got != "Snare" {
+		t.Errorf("got label %q, want Snare", got)
+	}
+	// New ones after the saved IDs and positions
+	hihat := mapper.Get("hihat")
+	if hihat != 2 || mapper.Pos(hihat) != 3 {
+		t.Errorf("got hihat id %d at %d, want 2 at 3", hihat, mapper.Pos(hihat))
+	}
+	if id, ok := mapper.IdAt(2); !ok || id != 0 {
+		t.Errorf("got id %d at pos 2, want kick", id)
+	}
+	// Looking up leaves unknown names out
+	if id, ok := mapper.Id("tom"); ok {
+		t.Errorf("got id %d for an unknown name", id)
+	}
+	if got := len(mapper.Names()); got != 3 {
+		t.Errorf("got %d names, want 3", got)
+	}
+}
+
+func TestCheckEntries(t *testing.T) {
+	valid := []RegistryEntry{{Name: "kick", Id: 0, Pos: 1}, {Name: "snare", Id: 1, Pos: 0}}
+	if err := checkEntries(valid); err != nil {
+		t.Errorf("want valid, got %v", err)
+	}
+	samePos := []RegistryEntry{{Name: "kick", Id: 0, Pos: 1}, {Name: "snare", Id: 1, Pos: 1}}
+	if err := checkEntries(samePos); err == nil {
+		t.Errorf("want an error for two pads in the same position")
+	}
+	pastEnd := []RegistryEntry{{Name: "kick", Id: 0, Pos: 0}, {Name: "snare", Id: 1, Pos: 5}}
+	if err := checkEntries(pastEnd); err == nil {
+		t.Errorf("want an error for a pad past the end")
+	}
+}
+
+func TestDeclareOrder(t *testing.T) {
+	*registryPath = ""
+	trosces := NewTrosces()
+	trosces.DeclareInstrument("drums", "kick", nil, "", -1)
+	trosces.DeclareInstrument("drums", "snare", nil, "", 5)
+
+	snare, _ := trosces.drums.mapper.Id("snare")
+	if pos := trosces.drums.mapper.Pos(snare); pos != 1 {
+		t.Errorf("got snare at %d, want left at 1", pos)
+	}
+	trosces.DeclareInstrument("drums", "snare", nil, "", 0)
+	if pos := trosces.drums.mapper.Pos(snare); pos != 0 {
+		t.Errorf("got snare at %d, want moved to 0", pos)
+	}
+}
+
+func TestMapperMove(t *testing.T) {
+	mapper := NewMapper()
+	hihat := mapper.Get("hihat")
+	kick := mapper.Get("kick")
+
+	if old := mapper.Move(kick, 0); old != 1 {
+		t.Errorf("got kick moved from %d, want 1", old)
+	}
+	if mapper.Pos(kick) != 0 || mapper.Pos(hihat) != 1 {
+		t.Errorf("got kick at %d and hihat at %d, want swapped", mapper.Pos(kick), mapper.Pos(hihat))
+	}
+	if snare := mapper.Get("snare"); mapper.Pos(snare) != 2 {
+		t.Errorf("got snare at %d, want 2", mapper.Pos(snare))
+	}
+}
+
+// Restored IDs can skip some, which soloing goes past.
+func TestSoloNextSparse(t *testing.T) {
+	*registryPath = ""
+	trosces := NewTrosces()
+	trosces.keyboard.mapper.Set("bass", 0, 0, "")
+	trosces.keyboard.mapper.Set("lead", 3, 1, "")
+
+	for _, want := range []int{0, 3, -1} {
+		trosces.SoloNext("keyboard")
+		soloed := trosces.visibility["keyboard"].soloed
+		if want < 0 && len(soloed) != 0 || want >= 0 && (len(soloed) != 1 || !soloed[want]) {
+			t.Errorf("got %v soloed, want %d", soloed, want)
+		}
+	}
+}
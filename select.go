@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+)
+
+// Key or pad in the header under the screen coordinates, if any.
+func (trosces *Trosces) headerAt(cursorX, cursorY int) (*Track, int, bool) {
+	x, y := float32(cursorX), float32(cursorY)
+	for _, placement := range trosces.placements() {
+		track := placement.track
+		if x < placement.x || x >= placement.x+track.Width() || y < placement.y || y >= placement.y+track.header.keyHeight {
+			continue
+		}
+		// The header is repeated for each column of the trail
+		columnX := x - placement.x
+		for columnX >= track.header.Width() {
+			columnX -= track.header.Width()
+		}
+		pos, ok := track.header.PosAt(columnX)
+		return track, pos, ok
+	}
+	return nil, 0, false
+}
+
+// Toggle the clicked key or pad in the highlight and tell the host.
+func (trosces *Trosces) click(cursorX, cursorY int) {
+	track, pos, ok := trosces.headerAt(cursorX, cursorY)
+	if !ok {
+		return
+	}
+
+	switch {
+	case track == trosces.drums:
+		trosces.drumHighlight = toggle(trosces.drumHighlight, pos)
+		highlight := trosces.drumHighlight
+
+		trosces.drums.header.SetHighlight(highlight)
+		if trosces.cue != nil {
+			names := trosces.drums.mapper.Names()
+			var args []string
+			for _, pos := range highlight {
+				if id, ok := trosces.drums.mapper.IdAt(pos); ok {
+					args = append(args, names[id])
+				}
+			}
+			trosces.cue.Send(*cueDrumsPath, args)
+		}
+	case track.header.keyboard:
+		highlight := toggle(trosces.highlight, pos)
+
+		trosces.SetHighlight(highlight)
+		if trosces.cue != nil {
+			var args []string
+			for _, pos := range highlight {
+				args = append(args, trosces.tuning.Symbol(pos))
+			}
+			trosces.cue.Send(*cueNotesPath, args)
+		}
+	}
+}
+
+// Copy of the sorted set with the position added or removed.
+func toggle(set []int, pos int) []int {
+	toggled := make([]int, 0, len(set)+1)
+	found := false
+	for _, p := range set {
+		if p == pos {
+			found = true
+		} else {
+			toggled = append(toggled, p)
+		}
+	}
+	if !found {
+		toggled = append(toggled, pos)
+		sort.Ints(toggled)
+	}
+	return toggled
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// What a running Trosces is showing, served as JSON on /state.
+type State struct {
+	Beat   float32 `json:"beat"`
+	Bpm    float32 `json:"bpm"`
+	Frozen bool    `json:"frozen"`
+
+	// Selected keys and drum pads
+	Highlight     []int `json:"highlight"`
+	DrumHighlight []int `json:"drum_highlight"`
+
+	// Instrument, drum and layer IDs by name
+	Keyboard map[string]int `json:"keyboard"`
+	Drums    map[string]int `json:"drums"`
+	Layers   map[string]int `json:"layers"`
+	// Variant IDs by layer name and variant name
+	Variants map[string]map[string]int `json:"variants"`
+
+	Tracks []*TrackState `json:"tracks"`
+}
+
+type TrackState struct {
+	Name      string       `json:"name"`
+	Hidden    bool         `json:"hidden"`
+	MinPos    int          `json:"min_pos"`
+	MaxPos    int          `json:"max_pos"`
+	ActivePos []int        `json:"active_pos"`
+	Spans     []*SpanState `json:"spans"`
+}
+
+type SpanState struct {
+	Id    int     `json:"id"`
+	Pos   int     `json:"pos"`
+	Start float32 `json:"start"`
+	// Missing while still being held
+	End      *float32 `json:"end,omitempty"`
+	Velocity float32  `json:"velocity"`
+	Label    string   `json:"label,omitempty"`
+}
+
+// Snapshot of the state, with the spans between the beats. Without a range,
+// the spans currently visible on each track.
+func (trosces *Trosces) State(start, end *float32) *State {
+	now := trosces.pulse.Horizon()
+
+	highlight := append([]int{}, trosces.highlight...)
+	drumHighlight := append([]int{}, trosces.drumHighlight...)
+
+	state := &State{
+		Beat:          now.Beat(),
+		Bpm:           trosces.pulse.bpm,
+		Frozen:        trosces.pulse.IsFrozen(),
+		Highlight:     highlight,
+		DrumHighlight: drumHighlight,
+		Keyboard:      trosces.keyboard.mapper.Ids(),
+		Drums:         trosces.drums.mapper.Ids(),
+		Layers:        trosces.layers.mapper.Ids(),
+		Variants:      map[string]map[string]int{},
+	}
+	for name, lNum := range state.Layers {
+		state.Variants[name] = trosces.variantMapper(lNum).Ids()
+	}
+
+	for _, name := range trackNames {
+		tracks, _ := trosces.namedTracks(name)
+		if name == "keyboard" {
+			// Only the split keyboards if any, not the template for new ones
+			tracks = trosces.keyboardTracks()
+		}
+		for _, track := range tracks {
+			from, to := now.Sub(track.trail.length), now
+			if start != nil {
+				from = OnBeat(*start)
+			}
+			if end != nil {
+				to = OnBeat(*end)
+			}
+
+			trackState := &TrackState{
+				Name:      name,
+				Hidden:    trosces.hidden[name],
+				ActivePos: track.trail.ActivePos(),
+				Spans:     []*SpanState{},
+			}
+			trackState.MinPos, trackState.MaxPos = track.trail.Range()
+			for _, span := range track.trail.Spans(from, to) {
+				event := trosces.spanEvent(name, *span)
+				trackState.Spans = append(trackState.Spans, &SpanState{
+					Id:       event.Id,
+					Pos:      event.Pos,
+					Start:    event.Start,
+					End:      event.End,
+					Velocity: event.Velocity,
+					Label:    event.Label,
+				})
+			}
+			state.Tracks = append(state.Tracks, trackState)
+		}
+	}
+	return state
+}
+
+// Optional beat number from the query.
+func beatParam(r *http.Request, name string) (*float32, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	beat, err := strconv.ParseFloat(value, 32)
+	if err != nil || math.IsNaN(beat) || math.IsInf(beat, 0) {
+		return nil, fmt.Errorf("expected a beat number, got %q", value)
+	}
+	b := float32(beat)
+	return &b, nil
+}
+
+// Serve the state, optionally limited to spans between `?start=` and
+// `?end=` beats.
+func (trosces *Trosces) serveState(w http.ResponseWriter, r *http.Request) {
+	start, err := beatParam(r, "start")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid start: %v", err), http.StatusBadRequest)
+		return
+	}
+	end, err := beatParam(r, "end")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid end: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var state *State
+	if !trosces.Wait(func() { state = trosces.State(start, end) }) {
+		http.Error(w, "Busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		log.Printf("Failed to send state: %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitKeyboardState(t *testing.T) {
+	*registryPath = ""
+	*splitKeyboard = "side"
+	defer func() { *splitKeyboard = "" }()
+	trosces := NewTrosces()
+	trosces.PlayNote("bass", 36, trosces.pulse.Now(), Beats(1), 1)
+	trosces.PlayNote("lead", 60, trosces.pulse.Now(), Beats(1), 1)
+
+	var keyboards int
+	for _, track := range trosces.State(nil, nil).Tracks {
+		if track.Name == "keyboard" {
+			keyboards++
+			if len(track.Spans) != 1 {
+				t.Errorf("got %d spans, want 1 on each keyboard", len(track.Spans))
+			}
+		}
+	}
+	if keyboards != 2 {
+		t.Errorf("got %d keyboard tracks, want one for each instrument", keyboards)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"image/color"
+	"math"
+)
+
+var (
+	drumGrid  = flag.Bool("drum-grid", false, "Show drums as a step sequencer grid instead of a trail")
+	drumLoop  = flag.Float64("drum-loop", 4, "Loop length of the drum grid, in beats")
+	drumSteps = flag.Int("drum-steps", 16, "Number of steps in the drum grid loop")
+	drumLoops = flag.Int("drum-loops", 4, "Number of loops it takes for a hit to fade out of the drum grid")
+)
+
+// Most steps in a loop of the drum grid.
+const maxDrumSteps = 256
+
+// Step sequencer view of a trail: time is folded modulo the loop length.
+type StepGrid struct {
+	trail *Trail
+	loop  Duration
+	steps int
+	loops int
+}
+
+type StepCell struct {
+	pos  int
+	step int
+}
+
+type StepLevel struct {
+	// Instrument ID of the strongest hit
+	id int
+	// Strength of the hit faded by age, 0..1
+	level float32
+}
+
+func NewStepGrid(trail *Trail, loop Duration, steps int, loops int) *StepGrid {
+	trail.SetRetain(Beats(loop.Beats() * float32(loops)))
+	return &StepGrid{
+		trail: trail,
+		loop:  loop,
+		steps: steps,
+		loops: loops,
+	}
+}
+
+// Step within the loop for the time, rounded to the nearest step.
+func (grid *StepGrid) Step(t Time) int {
+	phase := t.Delta(t.Truncate(grid.loop)).Beats()
+	stepSize := grid.loop.Beats() / float32(grid.steps)
+	return int(math.Round(float64(phase/stepSize))) % grid.steps
+}
+
+// Strongest recent hit for each cell, fading out linearly over the loops.
+func (grid *StepGrid) Levels(now Time, spans []*Span) map[StepCell]StepLevel {
+	fadeOut := grid.loop.Beats() * float32(grid.loops)
+	levels := map[StepCell]StepLevel{}
+	for _, span := range spans {
+		age := now.Delta(span.start).Beats()
+		if age < 0 || age >= fadeOut {
+			continue
+		}
+		level := span.velocity * (1 - age/fadeOut)
+		cell := StepCell{pos: span.pos, step: grid.Step(span.start)}
+		if level > levels[cell].level {
+			levels[cell] = StepLevel{id: span.id, level: level}
+		}
+	}
+	return levels
+}
+
+// Scale (premultiplied) color including its alpha.
+func fade(c color.Color, alpha float32) color.Color {
+	r, g, b, a := c.RGBA()
+	scale := func(v uint32) uint8 {
+		return uint8(float32(v>>8) * alpha)
+	}
+	return color.RGBA{scale(r), scale(g), scale(b), scale(a)}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/hypebeast/go-osc/osc"
+)
+
+var (
+	themeFlag = flag.String("theme", "dark", "Color theme: dark, light, high-contrast, deuteranopia, protanopia, or a path to a JSON theme file")
+	themeDir  = flag.String("theme-dir", "", "Directory of JSON theme files that /trosces/theme may switch to by file name")
+)
+
+// Color written as "#rrggbb" or "#rrggbbaa" in JSON, not premultiplied.
+type HexColor color.NRGBA
+
+func (c HexColor) RGBA() (r, g, b, a uint32) {
+	return color.NRGBA(c).RGBA()
+}
+
+func hex(s string) HexColor {
+	c, err := parseHexColor(s)
+	if err != nil {
+		panic(err)
+	}
+	return HexColor(color.NRGBAModel.Convert(c).(color.NRGBA))
+}
+
+func (c HexColor) MarshalJSON() ([]byte, error) {
+	n := color.NRGBA(c)
+	s := fmt.Sprintf("#%02x%02x%02x", n.R, n.G, n.B)
+	if n.A != 0xff {
+		s += fmt.Sprintf("%02x", n.A)
+	}
+	return json.Marshal(s)
+}
+
+func (c *HexColor) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := parseHexColor(s)
+	if err != nil {
+		return err
+	}
+	*c = HexColor(color.NRGBAModel.Convert(parsed).(color.NRGBA))
+	return nil
+}
+
+// Every color drawn, apart from the instruments.
+type Theme struct {
+	// Name of the instrument palette to switch to, if any
+	Palette    string   `json:"palette,omitempty"`
+	Background HexColor `json:"background"`
+
+	// Keys and pads in the headers
+	WhiteKey          HexColor `json:"white_key"`
+	WhiteKeyHighlight HexColor `json:"white_key_highlight"`
+	WhiteKeyActive    HexColor `json:"white_key_active"`
+	BlackKey          HexColor `json:"black_key"`
+	BlackKeyHighlight HexColor `json:"black_key_highlight"`
+	BlackKeyActive    HexColor `json:"black_key_active"`
+	KeyBorder         HexColor `json:"key_border"`
+	KeyLabel          HexColor `json:"key_label"`
+
+	// Columns and lines behind the spans
+	ColumnBorder HexColor `json:"column_border"`
+	WhiteColumn  HexColor `json:"white_column"`
+	BlackColumn  HexColor `json:"black_column"`
+	// Columns of keys not in the highlight
+	DimmedColumn HexColor `json:"dimmed_column"`
+	OctaveLine   HexColor `json:"octave_line"`
+	BucketLine   HexColor `json:"bucket_line"`
+	GridLine     HexColor `json:"grid_line"`
+	SpanLabel    HexColor `json:"span_label"`
+	PlayHead     HexColor `json:"play_head"`
+	// Where keys were left out of the compact keyboard
+	GapMarker HexColor `json:"gap_marker"`
+
+	// Drum step sequencer grid
+	StepCell    HexColor `json:"step_cell"`
+	StepBeat    HexColor `json:"step_beat"`
+	StepCurrent HexColor `json:"step_current"`
+	StepBorder  HexColor `json:"step_border"`
+
+	// Legend and tooltip
+	PanelBackground   HexColor `json:"panel_background"`
+	PanelText         HexColor `json:"panel_text"`
+	PanelDimmedText   HexColor `json:"panel_dimmed_text"`
+	TooltipBackground HexColor `json:"tooltip_background"`
+	TooltipBorder     HexColor `json:"tooltip_border"`
+}
+
+var (
+	darkTheme = &Theme{
+		Palette:    "bright",
+		Background: hex("#000000"),
+
+		WhiteKey:          hex("#b79a9a"),
+		WhiteKeyHighlight: hex("#dabfbf"),
+		WhiteKeyActive:    hex("#fde5e5"),
+		BlackKey:          hex("#181111"),
+		BlackKeyHighlight: hex("#382a2a"),
+		BlackKeyActive:    hex("#594444"),
+		KeyBorder:         hex("#000000"),
+		KeyLabel:          hex("#181111"),
+
+		ColumnBorder: hex("#000000"),
+		WhiteColumn:  hex("#303030"),
+		BlackColumn:  hex("#202020"),
+		DimmedColumn: hex("#000000"),
+		OctaveLine:   hex("#808080"),
+		BucketLine:   hex("#c0c0c0"),
+		GridLine:     hex("#808080"),
+		SpanLabel:    hex("#000000"),
+		PlayHead:     hex("#ffffff"),
+		GapMarker:    hex("#e0a040"),
+
+		StepCell:    hex("#202020"),
+		StepBeat:    hex("#303030"),
+		StepCurrent: hex("#606060"),
+		StepBorder:  hex("#000000"),
+
+		PanelBackground:   hex("#000000c0"),
+		PanelText:         hex("#ffffff"),
+		PanelDimmedText:   hex("#606060"),
+		TooltipBackground: hex("#181818f0"),
+		TooltipBorder:     hex("#808080"),
+	}
+
+	themes = map[string]*Theme{
+		"dark": darkTheme,
+		// For daylight stages
+		"light": &Theme{
+			Palette:    "bright",
+			Background: hex("#f0f0ec"),
+
+			WhiteKey:          hex("#ffffff"),
+			WhiteKeyHighlight: hex("#f0d8b0"),
+			WhiteKeyActive:    hex("#e8a050"),
+			BlackKey:          hex("#303030"),
+			BlackKeyHighlight: hex("#806040"),
+			BlackKeyActive:    hex("#c07020"),
+			KeyBorder:         hex("#909090"),
+			KeyLabel:          hex("#303030"),
+
+			ColumnBorder: hex("#c8c8c4"),
+			WhiteColumn:  hex("#ffffff"),
+			BlackColumn:  hex("#e8e8e4"),
+			DimmedColumn: hex("#c8c8c4"),
+			OctaveLine:   hex("#707070"),
+			BucketLine:   hex("#404040"),
+			GridLine:     hex("#a0a0a0"),
+			SpanLabel:    hex("#000000"),
+			PlayHead:     hex("#000000"),
+			GapMarker:    hex("#b05000"),
+
+			StepCell:    hex("#ffffff"),
+			StepBeat:    hex("#e0e0dc"),
+			StepCurrent: hex("#b0b0ac"),
+			StepBorder:  hex("#c8c8c4"),
+
+			PanelBackground:   hex("#ffffffd0"),
+			PanelText:         hex("#000000"),
+			PanelDimmedText:   hex("#a0a0a0"),
+			TooltipBackground: hex("#fffff0f0"),
+			TooltipBorder:     hex("#404040"),
+		},
+		"high-contrast": &Theme{
+			Palette:    "vibrant",
+			Background: hex("#000000"),
+
+			WhiteKey:          hex("#ffffff"),
+			WhiteKeyHighlight: hex("#00e0ff"),
+			WhiteKeyActive:    hex("#ffff00"),
+			BlackKey:          hex("#000000"),
+			BlackKeyHighlight: hex("#0060a0"),
+			BlackKeyActive:    hex("#a0a000"),
+			KeyBorder:         hex("#808080"),
+			KeyLabel:          hex("#000000"),
+
+			ColumnBorder: hex("#000000"),
+			WhiteColumn:  hex("#383838"),
+			BlackColumn:  hex("#181818"),
+			DimmedColumn: hex("#000000"),
+			OctaveLine:   hex("#ffffff"),
+			BucketLine:   hex("#ffffff"),
+			GridLine:     hex("#a0a0a0"),
+			SpanLabel:    hex("#000000"),
+			PlayHead:     hex("#ffff00"),
+			GapMarker:    hex("#00ffff"),
+
+			StepCell:    hex("#181818"),
+			StepBeat:    hex("#383838"),
+			StepCurrent: hex("#909090"),
+			StepBorder:  hex("#000000"),
+
+			PanelBackground:   hex("#000000"),
+			PanelText:         hex("#ffffff"),
+			PanelDimmedText:   hex("#808080"),
+			TooltipBackground: hex("#000000"),
+			TooltipBorder:     hex("#ffffff"),
+		},
+		// Blue and orange accents instead of red and green, told apart by
+		// lightness too
+		"deuteranopia": &Theme{
+			Palette:    "okabe-ito",
+			Background: hex("#000000"),
+
+			WhiteKey:          hex("#a0a8b8"),
+			WhiteKeyHighlight: hex("#a8c8f0"),
+			WhiteKeyActive:    hex("#ffd8a0"),
+			BlackKey:          hex("#101418"),
+			BlackKeyHighlight: hex("#204060"),
+			BlackKeyActive:    hex("#806030"),
+			KeyBorder:         hex("#000000"),
+			KeyLabel:          hex("#101418"),
+
+			ColumnBorder: hex("#000000"),
+			WhiteColumn:  hex("#303030"),
+			BlackColumn:  hex("#202020"),
+			DimmedColumn: hex("#000000"),
+			OctaveLine:   hex("#808080"),
+			BucketLine:   hex("#c0c0c0"),
+			GridLine:     hex("#808080"),
+			SpanLabel:    hex("#000000"),
+			PlayHead:     hex("#ffffff"),
+			GapMarker:    hex("#e0a040"),
+
+			StepCell:    hex("#202020"),
+			StepBeat:    hex("#303030"),
+			StepCurrent: hex("#606060"),
+			StepBorder:  hex("#000000"),
+
+			PanelBackground:   hex("#000000c0"),
+			PanelText:         hex("#ffffff"),
+			PanelDimmedText:   hex("#606060"),
+			TooltipBackground: hex("#181818f0"),
+			TooltipBorder:     hex("#808080"),
+		},
+		// Reds look dark, so blue and yellow accents
+		"protanopia": &Theme{
+			Palette:    "okabe-ito",
+			Background: hex("#000000"),
+
+			WhiteKey:          hex("#a8a8b0"),
+			WhiteKeyHighlight: hex("#98b8f8"),
+			WhiteKeyActive:    hex("#fff0a0"),
+			BlackKey:          hex("#101018"),
+			BlackKeyHighlight: hex("#203870"),
+			BlackKeyActive:    hex("#787020"),
+			KeyBorder:         hex("#000000"),
+			KeyLabel:          hex("#101018"),
+
+			ColumnBorder: hex("#000000"),
+			WhiteColumn:  hex("#303030"),
+			BlackColumn:  hex("#202020"),
+			DimmedColumn: hex("#000000"),
+			OctaveLine:   hex("#808080"),
+			BucketLine:   hex("#c0c0c0"),
+			GridLine:     hex("#808080"),
+			SpanLabel:    hex("#000000"),
+			PlayHead:     hex("#ffffff"),
+			GapMarker:    hex("#e0a040"),
+
+			StepCell:    hex("#202020"),
+			StepBeat:    hex("#303030"),
+			StepCurrent: hex("#606060"),
+			StepBorder:  hex("#000000"),
+
+			PanelBackground:   hex("#000000c0"),
+			PanelText:         hex("#ffffff"),
+			PanelDimmedText:   hex("#606060"),
+			TooltipBackground: hex("#181818f0"),
+			TooltipBorder:     hex("#808080"),
+		},
+	}
+	themeNames = []string{"dark", "light", "high-contrast", "deuteranopia", "protanopia"}
+
+	// Colors drawn with, switched on the game loop
+	theme = darkTheme
+)
+
+// Preset by name, or loaded from a JSON file with any colors left out taken
+// from the dark theme.
+func LoadTheme(name string) (*Theme, error) {
+	if preset, ok := themes[name]; ok {
+		return preset, nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("not a preset or a readable theme file: %v", err)
+	}
+	loaded := *darkTheme
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("invalid theme file %s: %v", name, err)
+	}
+	if loaded.Palette != "" {
+		if _, ok := palettes[loaded.Palette]; !ok {
+			return nil, fmt.Errorf("invalid theme file %s: unknown palette %q", name, loaded.Palette)
+		}
+	}
+	return &loaded, nil
+}
+
+// Preset by name, or a file in the directory named by its file name, for
+// themes switched remotely without reading files from anywhere else.
+func LoadThemeFrom(dir string, name string) (*Theme, error) {
+	if preset, ok := themes[name]; ok {
+		return preset, nil
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("not a preset, and theme files are only read with -theme-dir")
+	}
+	if err := checkFileName(name); err != nil {
+		return nil, fmt.Errorf("not a preset, and %v", err)
+	}
+	return LoadTheme(filepath.Join(dir, name))
+}
+
+// Draw everything with the theme from now on.
+func (trosces *Trosces) SetTheme(name string, t *Theme) {
+	theme = t
+	trosces.themeName = name
+	if t.Palette != "" {
+		if err := trosces.SetPalette(t.Palette); err != nil {
+			log.Printf("Invalid theme palette: %v", err)
+		}
+	}
+	for _, trackName := range trackNames {
+		tracks, _ := trosces.namedTracks(trackName)
+		for _, track := range tracks {
+			track.header.Redraw()
+			track.trail.Redraw()
+		}
+	}
+	trosces.publish(trosces.themeEvent())
+}
+
+// Switch to the next preset theme.
+func (trosces *Trosces) CycleTheme() {
+	next := themeNames[0]
+	for i, name := range themeNames {
+		if name == trosces.themeName {
+			next = themeNames[(i+1)%len(themeNames)]
+		}
+	}
+	trosces.SetTheme(next, themes[next])
+}
+
+func addThemeHandlers(d *countingDispatcher, trosces *Trosces) {
+	d.AddMsgHandler("/trosces/theme", func(msg *osc.Message) {
+		var err error
+		if err = CheckArgs(msg.Arguments, 1, 1); err != nil {
+			invalid("/trosces/theme", "Invalid /trosces/theme: %v", err)
+			return
+		}
+
+		var name string
+		var t *Theme
+
+		if name, err = NameArg(msg.Arguments[0]); err != nil {
+			invalid("/trosces/theme", "Invalid /trosces/theme[0] name: %v", err)
+			return
+		}
+		// Files are read here rather than on the game loop
+		if t, err = LoadThemeFrom(*themeDir, name); err != nil {
+			invalid("/trosces/theme", "Invalid /trosces/theme[0] name: %v", err)
+			return
+		}
+
+		trosces.Do(func() {
+			trosces.SetTheme(name, t)
+		})
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "theme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "theme.json")
+	if err := ioutil.WriteFile(path, []byte(`{"background": "#102030", "panel_background": "#00000080"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadTheme(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.NRGBA(loaded.Background); got != (color.NRGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Errorf("got background %v, want #102030", got)
+	}
+	if got := color.NRGBA(loaded.PanelBackground); got != (color.NRGBA{0, 0, 0, 0x80}) {
+		t.Errorf("got panel background %v, want #00000080", got)
+	}
+	if loaded.WhiteKey != darkTheme.WhiteKey {
+		t.Errorf("colors left out should be taken from the dark theme")
+	}
+
+	data, err := json.Marshal(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again Theme
+	if err := json.Unmarshal(data, &again); err != nil {
+		t.Fatal(err)
+	}
+	if again != *loaded {
+		t.Errorf("theme changed after a round trip through %s", data)
+	}
+
+	if _, err := LoadTheme("no-such-theme"); err == nil {
+		t.Errorf("want an error for an unknown theme")
+	}
+
+	// Remotely, only presets and files in the directory
+	if _, err := LoadThemeFrom(dir, "theme.json"); err != nil {
+		t.Errorf("got %v for a file in the directory", err)
+	}
+	if preset, err := LoadThemeFrom("", "light"); err != nil || preset != themes["light"] {
+		t.Errorf("got %v for a preset, want the light theme", err)
+	}
+	for _, name := range []string{path, "../theme.json", "", ".."} {
+		if _, err := LoadThemeFrom(dir, name); err == nil {
+			t.Errorf("%q: want an error outside the directory", name)
+		}
+	}
+	if _, err := LoadThemeFrom("", "theme.json"); err == nil {
+		t.Errorf("want an error without a directory")
+	}
+}
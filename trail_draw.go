@@ -0,0 +1,356 @@
+//go:build !tui
+// +build !tui
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"log"
+	"runtime/trace"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/vector"
+)
+
+// Images tracking
+type trailImages struct {
+	// all spans slotted by time buckets
+	cached map[Time]*ebiten.Image
+	// whether the image above is ready or needs a redraw
+	cachedReady map[Time]bool
+	// as above, but for the background grid
+	grid      *ebiten.Image
+	gridReady bool
+	// discarded images ready for reuse
+	unused []*ebiten.Image
+}
+
+func newTrailImages() trailImages {
+	return trailImages{
+		cached:      map[Time]*ebiten.Image{},
+		cachedReady: map[Time]bool{},
+		unused:      []*ebiten.Image{},
+	}
+}
+
+// Draw all the trail components.
+func (trail *Trail) Draw(ctxt context.Context, screen *ebiten.Image, op *ebiten.DrawImageOptions) {
+	defer trace.StartRegion(ctxt, "DrawTrail").End()
+	if trail.cycleView {
+		trail.drawCycles(ctxt, screen, op)
+		return
+	}
+	now := trail.pulse.Horizon()
+
+	// History (time < now) flows away from 0.
+
+	// Bucket covering now, extensing at most bucketSize to the future
+	bucketTime := now.Truncate(trail.bucketSize)
+	// End of the scroll trail
+	trailEnd := now.Sub(trail.length)
+
+	// Visible part of the trail, anything outside is cropped
+	height := trail.length.Beats() * trail.beatSize
+
+	// Until we find a bucket that covers the end of the trail
+	for bucketTime.Add(trail.bucketSize).After(trailEnd) {
+		bucketImage := trail.getCachedBucket(ctxt, bucketTime)
+		bucketOp := ebiten.DrawImageOptions{}
+		bucketOp.GeoM = op.GeoM
+		// bucket images contain [bucketTime+bucketSize (fresher edge, y=0) ... bucketTime (older edge, y>0)]
+		// now -> on screen y=0, future -> on screen y<0
+		offset := now.Delta(bucketTime.Add(trail.bucketSize)).Beats() * trail.beatSize
+		// Crop the future (y<0) and the end of the trail (y>height)
+		bounds := bucketImage.Bounds()
+		top, bottom := 0, bounds.Max.Y
+		if offset < 0 {
+			top = int(-offset)
+		}
+		if offset+float32(bottom) > height {
+			bottom = int(height - offset)
+		}
+		if top < bottom {
+			bucketOp.GeoM.Translate(0, float64(offset+float32(top)))
+			crop := bucketImage.SubImage(image.Rect(0, top, bounds.Max.X, bottom)).(*ebiten.Image)
+			screen.DrawImage(crop, &bucketOp)
+		}
+		// move to one older bucket
+		bucketTime = bucketTime.Sub(trail.bucketSize)
+	}
+}
+
+// Draw the last cycles side by side, oldest on the left and time flowing
+// downwards, so that repeating patterns line up.
+func (trail *Trail) drawCycles(ctxt context.Context, screen *ebiten.Image, op *ebiten.DrawImageOptions) {
+	now := trail.pulse.Horizon()
+	width := trail.width()
+	// Fit a whole cycle to the height of the trail
+	cycleBeatSize := trail.length.Beats() * trail.beatSize / trail.cycle.Beats()
+
+	current := now.Truncate(trail.cycle)
+	for age := 0; age < trail.cycles; age++ {
+		column := float64(trail.cycles-1-age) * float64(width)
+		cycleStart := current.Sub(Beats(trail.cycle.Beats() * float32(age)))
+		cycleEnd := cycleStart.Add(trail.cycle)
+		if cycleEnd.After(now) {
+			cycleEnd = now
+		}
+
+		for bucketTime := cycleStart.Truncate(trail.bucketSize); bucketTime.Before(cycleEnd); bucketTime = bucketTime.Add(trail.bucketSize) {
+			bucketEndTime := bucketTime.Add(trail.bucketSize)
+			// Part of the bucket within the cycle
+			start, end := bucketTime, bucketEndTime
+			if start.Before(cycleStart) {
+				start = cycleStart
+			}
+			if end.After(cycleEnd) {
+				end = cycleEnd
+			}
+
+			// bucket images contain [bucketTime+bucketSize (y=0) ... bucketTime (y>0)]
+			bucketImage := trail.getCachedBucket(ctxt, bucketTime)
+			top := int(bucketEndTime.Delta(end).Beats() * trail.beatSize)
+			bottom := int(bucketEndTime.Delta(start).Beats() * trail.beatSize)
+			if top >= bottom {
+				continue
+			}
+			crop := bucketImage.SubImage(image.Rect(0, top, bucketImage.Bounds().Max.X, bottom)).(*ebiten.Image)
+
+			// Flip and scale to the cycle
+			scale := float64(cycleBeatSize / trail.beatSize)
+			bucketOp := ebiten.DrawImageOptions{}
+			bucketOp.GeoM.Scale(1, -scale)
+			bucketOp.GeoM.Translate(column, float64(end.Delta(cycleStart).Beats()*cycleBeatSize))
+			bucketOp.GeoM.Concat(op.GeoM)
+			screen.DrawImage(crop, &bucketOp)
+		}
+	}
+
+	// Play head in the current cycle
+	x, y := op.GeoM.Apply(float64(trail.cycles-1)*float64(width), 0)
+	head := float32(y) + now.Delta(current).Beats()*cycleBeatSize
+	fillRect(screen, float32(x), head, float32(x)+width, head+trail.borderWidth, theme.PlayHead)
+}
+
+func (trail *Trail) redrawBucket(bucketTime Time) {
+	trail.cachedReady[bucketTime] = false
+}
+
+func (trail *Trail) redrawAll() {
+	trail.cachedReady = map[Time]bool{}
+	trail.gridReady = false
+}
+
+func (trail *Trail) resetAll() {
+	disposeLater := func(image *ebiten.Image) {
+		go func() {
+			time.Sleep(5 * time.Second)
+			image.Dispose()
+		}()
+	}
+
+	for _, image := range trail.cached {
+		disposeLater(image)
+	}
+	trail.cached = map[Time]*ebiten.Image{}
+
+	if trail.grid != nil {
+		disposeLater(trail.grid)
+	}
+	trail.grid = nil
+
+	for _, image := range trail.unused {
+		disposeLater(image)
+	}
+	trail.unused = []*ebiten.Image{}
+
+	trail.redrawAll()
+}
+
+func (trail *Trail) allocateImage() *ebiten.Image {
+	if len(trail.unused) > 0 {
+		log.Printf("Reusing unused (out of %d)", len(trail.unused))
+		image := trail.unused[len(trail.unused)-1]
+		trail.unused = trail.unused[:len(trail.unused)-1]
+		image.Clear()
+		metrics.ImageAllocated(true)
+		return image
+	}
+
+	log.Printf("Creating new image")
+	metrics.ImageAllocated(false)
+	return ebiten.NewImage(
+		int(trail.width()),
+		int(trail.bucketSize.Beats()*trail.beatSize),
+	)
+}
+
+// Produce a (cached) grid for trail background.
+func (trail *Trail) getCachedGrid(ctxt context.Context) *ebiten.Image {
+	defer trace.StartRegion(ctxt, "getCachedGrid").End()
+	if !trail.gridReady {
+		if trail.grid == nil {
+			trail.grid = trail.allocateImage()
+		}
+
+		// Columns with any of the highlighted positions, folded together
+		highlighted := map[int]bool{}
+		for pos := range trail.highlight {
+			if column, ok := trail.columns.Of(pos); ok {
+				highlighted[column] = true
+			}
+		}
+
+		// Key columns
+		for column := 0; column < trail.columns.Count(); column++ {
+			pos, _ := trail.columns.At(column)
+			basePos := column
+			var background color.Color
+
+			drawBar := func(offset, endOffset float32, c color.Color) {
+				path := vector.Path{}
+				path.MoveTo(float32(basePos)*trail.posWidth+offset, 0)
+				path.LineTo(float32(basePos)*trail.posWidth+offset, float32(trail.grid.Bounds().Max.Y))
+				path.LineTo(float32(basePos)*trail.posWidth+endOffset, float32(trail.grid.Bounds().Max.Y))
+				path.LineTo(float32(basePos)*trail.posWidth+endOffset, 0)
+				path.Fill(trail.grid, &vector.FillOptions{Color: c})
+			}
+
+			drawBar(0, trail.posWidth, theme.ColumnBorder)
+			if len(trail.highlight) > 0 && !highlighted[column] {
+				background = theme.DimmedColumn
+			} else if trail.tuning.IsWhite(pos) {
+				background = theme.WhiteColumn
+			} else {
+				background = theme.BlackColumn
+			}
+			drawBar(trail.borderWidth/2, trail.posWidth-trail.borderWidth/2, background)
+
+			if trail.tuning.IsRepeat(pos) {
+				drawBar(-trail.borderWidth/2, trail.borderWidth/2, theme.OctaveLine)
+			}
+			if trail.columns.GapBefore(column) {
+				// Dashes where positions were collapsed
+				x := float32(basePos) * trail.posWidth
+				for y := float32(0); y < float32(trail.grid.Bounds().Max.Y); y += 4 * trail.borderWidth {
+					fillRect(trail.grid, x-trail.borderWidth/2, y, x+trail.borderWidth/2, y+2*trail.borderWidth, theme.GapMarker)
+				}
+			}
+		}
+
+		// Timeline
+		for t := float32(0); t < trail.bucketSize.Beats(); t += trail.bucketSize.Beats() / float32(trail.gridSteps) {
+			baseTime := t * trail.beatSize
+
+			path := vector.Path{}
+			path.MoveTo(0, baseTime)
+			path.LineTo(float32(trail.grid.Bounds().Max.X), baseTime)
+			path.LineTo(float32(trail.grid.Bounds().Max.X), baseTime+trail.borderWidth)
+			path.LineTo(0, baseTime+trail.borderWidth)
+
+			var op vector.FillOptions
+			switch {
+			case baseTime == 0:
+				op.Color = theme.BucketLine
+			default:
+				op.Color = theme.GridLine
+			}
+
+			path.Fill(trail.grid, &op)
+		}
+
+		// Updated!
+		trail.gridReady = true
+	}
+	return trail.grid
+}
+
+func (trail *Trail) drawSubSpan(image *ebiten.Image, bucketTime Time, subSpan *SubSpan) {
+	start, end, offset, endOffset := trail.subSpanBounds(bucketTime, subSpan)
+
+	//log.Printf("Drawing: %v -> [%.1f : %.1f] in %v", span, start, end, imageBucketTime)
+
+	if start < 0 {
+		log.Printf("%v: start should be within bucket @%.1f: %.1f", subSpan, bucketTime.Beat(), start)
+		return
+	}
+	if end > float32(image.Bounds().Max.Y) {
+		log.Printf("%v: end should be within bucket @%.1f: %.1f", subSpan, bucketTime.Beat(), end)
+		return
+	}
+	if end > start {
+		log.Printf("%v: wrong order: %.1f > %.1f", subSpan, end, start)
+		return
+	}
+	if start-end < 1e-6 {
+		log.Printf("%v: too short: %.1f - %.1f < 1e-6", subSpan, start, end)
+		return
+	}
+
+	path := vector.Path{}
+	path.MoveTo(offset, start)
+	path.LineTo(offset, end)
+	path.LineTo(endOffset, end)
+	path.LineTo(endOffset, start)
+	path.Fill(image, &vector.FillOptions{
+		Color: trail.SpanColor(subSpan.span.id),
+	})
+	drawPattern(image, trail.SpanPattern(subSpan.span.id), offset, end, endOffset, start)
+
+	// Label at the start of the span, if it fits
+	if trail.showLabels && trail.labeler != nil && subSpan.first && start-end > labelHeight() {
+		label := fitLabel(trail.labeler(subSpan.span), endOffset-offset-2)
+		drawLabel(image, label, offset+1, start-labelHeight(), theme.SpanLabel)
+	}
+}
+
+// Produce a (cached) slice of the trail with spans.
+func (trail *Trail) getCachedBucket(ctxt context.Context, imageBucketTime Time) *ebiten.Image {
+	defer trace.StartRegion(ctxt, "getCachedBucket").End()
+
+	if !trail.cachedReady[imageBucketTime] {
+		if trail.cached[imageBucketTime] == nil {
+			trail.cached[imageBucketTime] = trail.allocateImage()
+		}
+		image := trail.cached[imageBucketTime]
+
+		image.DrawImage(trail.getCachedGrid(ctxt), &ebiten.DrawImageOptions{})
+
+		subSpans := trail.bucketSubSpans(imageBucketTime)
+		for _, subSpan := range subSpans {
+			trail.drawSubSpan(image, imageBucketTime, subSpan)
+		}
+		//log.Printf(
+		//	"New image slice %dx%d with %d spans for bucket at %v",
+		//	image.Bounds().Max.X, image.Bounds().Max.Y, spanCount, imageBucketTime,
+		//)
+
+		trail.cachedReady[imageBucketTime] = true
+	}
+	return trail.cached[imageBucketTime]
+}
+
+// Images of buckets, and those kept for reuse.
+func (trail *Trail) imageCounts() (int, int) {
+	return len(trail.cached), len(trail.unused)
+}
+
+// Keep the images of the buckets before the time for reuse.
+func (trail *Trail) releaseImages(before Time) {
+	freeCached := []Time{}
+	for bucketTime := range trail.cached {
+		if bucketTime.Add(trail.bucketSize).Before(before) {
+			freeCached = append(freeCached, bucketTime)
+		}
+	}
+	for _, bucketTime := range freeCached {
+		log.Printf("Adding %v to unused", bucketTime)
+		image := trail.cached[bucketTime]
+		trail.unused = append(trail.unused, image)
+		delete(trail.cached, bucketTime)
+		delete(trail.cachedReady, bucketTime)
+	}
+}
@@ -16,6 +16,7 @@ func TestSubSpanBounds(t *testing.T) {
 		borderWidth: 2,
 		posWidth:    14,
 		minPos:      0,
+		columns:     NewColumns(0, 0),
 	}
 
 	for _, tc := range []struct {
@@ -171,262 +172,54 @@ func TestSubSpanBounds(t *testing.T) {
 	}
 }
 
-func TestSubindex(t *testing.T) {
+func TestLanes(t *testing.T) {
+	voices := &Voices{}
 	for _, tc := range []struct {
 		name         string
-		spans        []*Span
-		wantSubSpans []*SubSpan
+		span         *Span
+		wantLane     int
+		wantLanes    int
+		wantNarrower bool
 	}{
 		{
-			name: "no overlap in time",
-			spans: []*Span{
-				&Span{
-					id:    0,
-					pos:   0,
-					start: OnBeat(0),
-					end:   OnBeat(0.5),
-				},
-				&Span{
-					id:    1,
-					pos:   0,
-					start: OnBeat(0.5),
-					end:   OnBeat(1.0),
-				},
-			},
-			wantSubSpans: []*SubSpan{
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0),
-					end:        OnBeat(0.5),
-					subindex:   0,
-					subindices: 1,
-					first:      true,
-					last:       true,
-				},
-				&SubSpan{
-					span:       &Span{id: 1},
-					start:      OnBeat(0.5),
-					end:        OnBeat(1.0),
-					subindex:   0,
-					subindices: 1,
-					first:      true,
-					last:       true,
-				},
-			},
+			name:      "alone",
+			span:      &Span{id: 0, start: OnBeat(0), end: OnBeat(1)},
+			wantLane:  0,
+			wantLanes: 1,
 		},
 		{
-			name: "no overlap in pos",
-			spans: []*Span{
-				&Span{
-					id:    0,
-					pos:   0,
-					start: OnBeat(0),
-					end:   OnBeat(1.0),
-				},
-				&Span{
-					id:    1,
-					pos:   1,
-					start: OnBeat(0),
-					end:   OnBeat(1.0),
-				},
-			},
-			wantSubSpans: []*SubSpan{
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0),
-					end:        OnBeat(1.0),
-					subindex:   0,
-					subindices: 1,
-					first:      true,
-					last:       true,
-				},
-				&SubSpan{
-					span:       &Span{id: 1},
-					start:      OnBeat(0),
-					end:        OnBeat(1.0),
-					subindex:   0,
-					subindices: 1,
-					first:      true,
-					last:       true,
-				},
-			},
+			name:      "after the previous one",
+			span:      &Span{id: 1, start: OnBeat(1), end: OnBeat(3)},
+			wantLane:  0,
+			wantLanes: 1,
 		},
 		{
-			name: "full overlap",
-			spans: []*Span{
-				&Span{
-					id:    0,
-					pos:   0,
-					start: OnBeat(0),
-					end:   OnBeat(1.0),
-				},
-				&Span{
-					id:    1,
-					pos:   0,
-					start: OnBeat(0),
-					end:   OnBeat(1.0),
-				},
-			},
-			wantSubSpans: []*SubSpan{
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0),
-					end:        OnBeat(1.0),
-					subindex:   0,
-					subindices: 2,
-					first:      true,
-					last:       true,
-				},
-				&SubSpan{
-					span:       &Span{id: 1},
-					start:      OnBeat(0),
-					end:        OnBeat(1.0),
-					subindex:   1,
-					subindices: 2,
-					first:      true,
-					last:       true,
-				},
-			},
+			name:         "overlapping",
+			span:         &Span{id: 2, start: OnBeat(2), end: OnBeat(5)},
+			wantLane:     1,
+			wantLanes:    2,
+			wantNarrower: true,
 		},
 		{
-			name: "partial overlap",
-			spans: []*Span{
-				&Span{
-					id:    0,
-					pos:   0,
-					start: OnBeat(0),
-					end:   OnBeat(0.8),
-				},
-				&Span{
-					id:    1,
-					pos:   0,
-					start: OnBeat(0.2),
-					end:   OnBeat(1.0),
-				},
-			},
-			wantSubSpans: []*SubSpan{
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0),
-					end:        OnBeat(0.2),
-					subindex:   0,
-					subindices: 1,
-					first:      true,
-					last:       false,
-				},
-				&SubSpan{
-					span:       &Span{id: 1},
-					start:      OnBeat(0.2),
-					end:        OnBeat(0.8),
-					subindex:   1,
-					subindices: 2,
-					first:      true,
-					last:       false,
-				},
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0.2),
-					end:        OnBeat(0.8),
-					subindex:   0,
-					subindices: 2,
-					first:      false,
-					last:       true,
-				},
-				&SubSpan{
-					span:       &Span{id: 1},
-					start:      OnBeat(0.8),
-					end:        OnBeat(1.0),
-					subindex:   0,
-					subindices: 1,
-					first:      false,
-					last:       true,
-				},
-			},
+			name:      "in the freed lane",
+			span:      &Span{id: 3, start: OnBeat(3), end: OnBeat(4)},
+			wantLane:  0,
+			wantLanes: 2,
 		},
 		{
-			name: "wholly contained",
-			spans: []*Span{
-				&Span{
-					id:    0,
-					pos:   0,
-					start: OnBeat(0),
-					end:   OnBeat(1.0),
-				},
-				&Span{
-					id:    1,
-					pos:   0,
-					start: OnBeat(0.2),
-					end:   OnBeat(0.8),
-				},
-			},
-			wantSubSpans: []*SubSpan{
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0),
-					end:        OnBeat(0.2),
-					subindex:   0,
-					subindices: 1,
-					first:      true,
-					last:       false,
-				},
-				&SubSpan{
-					span:       &Span{id: 1},
-					start:      OnBeat(0.2),
-					end:        OnBeat(0.8),
-					subindex:   1,
-					subindices: 2,
-					first:      true,
-					last:       true,
-				},
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0.2),
-					end:        OnBeat(0.8),
-					subindex:   0,
-					subindices: 2,
-					first:      false,
-					last:       false,
-				},
-				&SubSpan{
-					span:       &Span{id: 0},
-					start:      OnBeat(0.8),
-					end:        OnBeat(1.0),
-					subindex:   0,
-					subindices: 1,
-					first:      false,
-					last:       true,
-				},
-			},
+			name:      "all lanes free again",
+			span:      &Span{id: 4, start: OnBeat(6), end: OnBeat(7)},
+			wantLane:  0,
+			wantLanes: 1,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			subSpans := Subindex(tc.spans)
-			for i := 0; i < len(subSpans) && i < len(tc.wantSubSpans); i++ {
-				if i >= len(tc.wantSubSpans) {
-					t.Errorf("extra subspan[%d] = %v", i, subSpans[i])
-					continue
-				}
-				if i >= len(subSpans) {
-					t.Errorf("missing subspan[%d] = %v", i, tc.wantSubSpans[i])
-					continue
-				}
-				got := subSpans[i]
-				want := tc.wantSubSpans[i]
-				if !AlmostEqual(got.start.beat, want.start.beat) || !AlmostEqual(got.end.beat, want.end.beat) {
-					t.Errorf("subspan[%d] want start->end: %.3f->%.3f, got: %.3f->%.3f", i, want.start, want.end, got.start, got.end)
-				}
-				if got.subindex != want.subindex || got.subindices != want.subindices {
-					t.Errorf("subspan[%d] want indices: %d/%d, got: %d/%d", i, want.subindex, want.subindices, got.subindex, got.subindices)
-				}
-				if got.first != want.first {
-					t.Errorf("subspan[%d] want first: %t, got: %t", i, want.first, got.first)
-				}
-				if got.last != want.last {
-					t.Errorf("subspan[%d] want last: %t, got: %t", i, want.last, got.last)
-				}
-				if got.span.id != want.span.id {
-					t.Errorf("subspan[%d] want span id: %d, got: %d", i, want.span.id, got.span.id)
-				}
+			narrower := voices.Assign(tc.span)
+			if tc.span.lane != tc.wantLane || tc.span.lanes.count != tc.wantLanes {
+				t.Errorf("want lane %d/%d, got: %d/%d", tc.wantLane, tc.wantLanes, tc.span.lane, tc.span.lanes.count)
+			}
+			if narrower != tc.wantNarrower {
+				t.Errorf("want narrower: %t, got: %t", tc.wantNarrower, narrower)
 			}
 		})
 	}
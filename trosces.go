@@ -1,25 +1,38 @@
 package main
 
 import (
-	"context"
 	"errors"
+	"flag"
 	"image/color"
 	"log"
-	"runtime/trace"
+	"sort"
+	"time"
+)
 
-	"github.com/hajimehoshi/ebiten/v2"
-	"github.com/hajimehoshi/ebiten/v2/inpututil"
-	"github.com/hajimehoshi/ebiten/v2/vector"
+var (
+	splitKeyboard = flag.String("split-keyboard", "", "Separate keyboard track for each instrument, laid out \"side\" by side or \"stack\"ed")
+	showLegend    = flag.Bool("legend", true, "Show the legend of instrument colors")
+	variantLabels = flag.Bool("variant-labels", false, "Label layer variants inside their spans")
+	cycleView     = flag.Bool("cycle-view", false, "Show the keyboard as a cycle-stacked piano roll")
+	cycleBeats    = flag.Float64("cycle-beats", 16, "Length of a cycle in the cycle-stacked piano roll, in beats")
+	cycleCount    = flag.Int("cycles", 4, "Number of cycles shown side by side in the cycle-stacked piano roll")
 )
 
 type Track struct {
 	header *Header
 	trail  *Trail
 	mapper *Mapper
+
+	// Alternative view of the trail
+	stepGrid     *StepGrid
+	showStepGrid bool
 }
 
 func (track *Track) Resolve() {
-	track.header.SetRange(track.trail.minPos, track.trail.maxPos)
+	track.header.SetColumns(track.trail.columns)
+	if !track.header.keyboard {
+		track.header.SetLabels(track.mapper.Labels())
+	}
 	track.header.SetActive(track.trail.ActivePos())
 	updatedHighlight := track.header.GetUpdatedHighlight()
 	if updatedHighlight != nil {
@@ -27,15 +40,25 @@ func (track *Track) Resolve() {
 	}
 }
 
-func (track *Track) Draw(ctx context.Context, image *ebiten.Image, op *ebiten.DrawImageOptions) {
-	trailOp := *op
-	trailOp.GeoM.Translate(0, float64(track.header.keyHeight))
-	track.trail.Draw(ctx, image, &trailOp)
-	track.header.Draw(image, op)
+func (track *Track) Width() float32 {
+	return track.header.Width() * float32(track.trail.Columns())
 }
 
-func (track *Track) Width() float32 {
-	return track.header.Width()
+func (track *Track) Height() float32 {
+	return track.header.keyHeight + track.trail.length.Beats()*track.trail.beatSize
+}
+
+func NewKeyboardTrack(pulse *Pulse) *Track {
+	track := &Track{
+		header: NewHeader(15, 30),
+		trail:  NewTrail(Beats(1), Beats(4), 192, 15),
+		mapper: NewMapper(),
+	}
+	track.header.keyboard = true
+	track.trail.pulse = pulse
+	// By octaves
+	track.trail.rangeAlign = 12
+	return track
 }
 
 var Finished = errors.New("Trosces finished")
@@ -43,12 +66,21 @@ var Finished = errors.New("Trosces finished")
 type Mapper struct {
 	nameToId map[string]int
 	nextId   int
+	// Display names by ID, where other than the name
+	labels map[int]string
+	// Positions by ID, where laid out by instrument
+	positions map[int]int
+	nextPos   int
+	// Bumped on every change
+	version int
 }
 
 func NewMapper() *Mapper {
 	return &Mapper{
-		nameToId: map[string]int{},
-		nextId:   0,
+		nameToId:  map[string]int{},
+		nextId:    0,
+		labels:    map[int]string{},
+		positions: map[int]int{},
 	}
 }
 
@@ -57,11 +89,125 @@ func (m *Mapper) Get(name string) int {
 		return i
 	} else {
 		m.nameToId[name] = m.nextId
+		m.positions[m.nextId] = m.nextPos
 		m.nextId++
+		m.nextPos++
+		m.version++
 		return m.nameToId[name]
 	}
 }
 
+// ID of the name, if it was seen already.
+func (m *Mapper) Id(name string) (int, bool) {
+	id, ok := m.nameToId[name]
+	return id, ok
+}
+
+// Restore an earlier assignment.
+func (m *Mapper) Set(name string, id int, pos int, label string) {
+	m.nameToId[name] = id
+	m.positions[id] = pos
+	if label != "" && label != name {
+		m.labels[id] = label
+	} else {
+		delete(m.labels, id)
+	}
+	if id >= m.nextId {
+		m.nextId = id + 1
+	}
+	if pos >= m.nextPos {
+		m.nextPos = pos + 1
+	}
+	m.version++
+}
+
+func (m *Mapper) SetLabel(id int, label string) {
+	m.labels[id] = label
+	m.version++
+}
+
+// Move the ID to the position, and whatever was there to where it was.
+// Returns the position it was moved from.
+func (m *Mapper) Move(id int, pos int) int {
+	old := m.positions[id]
+	if other, ok := m.IdAt(pos); ok {
+		m.positions[other] = old
+	}
+	m.positions[id] = pos
+	if pos >= m.nextPos {
+		m.nextPos = pos + 1
+	}
+	m.version++
+	return old
+}
+
+// Display name by ID.
+func (m *Mapper) Label(id int) string {
+	if label, ok := m.labels[id]; ok {
+		return label
+	}
+	for name, i := range m.nameToId {
+		if i == id {
+			return name
+		}
+	}
+	return ""
+}
+
+func (m *Mapper) Pos(id int) int {
+	return m.positions[id]
+}
+
+// ID at the position, if any.
+func (m *Mapper) IdAt(pos int) (int, bool) {
+	for id, p := range m.positions {
+		if p == pos {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Display names by position.
+func (m *Mapper) Labels() map[int]string {
+	labels := make(map[int]string, len(m.nameToId))
+	for name, id := range m.nameToId {
+		if label, ok := m.labels[id]; ok {
+			name = label
+		}
+		labels[m.positions[id]] = name
+	}
+	return labels
+}
+
+// Names by ID.
+func (m *Mapper) Names() map[int]string {
+	names := make(map[int]string, len(m.nameToId))
+	for name, id := range m.nameToId {
+		names[id] = name
+	}
+	return names
+}
+
+// IDs in ascending order, which may skip some when restored.
+func (m *Mapper) SortedIds() []int {
+	ids := make([]int, 0, len(m.nameToId))
+	for _, id := range m.nameToId {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// IDs by name.
+func (m *Mapper) Ids() map[string]int {
+	ids := make(map[string]int, len(m.nameToId))
+	for name, id := range m.nameToId {
+		ids[name] = id
+	}
+	return ids
+}
+
 type Trosces struct {
 	pulse *Pulse
 
@@ -70,16 +216,87 @@ type Trosces struct {
 	layers   *Track
 
 	variantMappers map[int]*Mapper
+
+	// Keyboard tracks by instrument, when split
+	instruments map[int]*Track
+	// Highlight for any new keyboard tracks
+	highlight []int
+	// Selected drum pads
+	drumHighlight []int
+	// Where to send selected keys and pads, if anywhere
+	cue *Cue
+	// Browsers watching, if serving the web UI
+	web *WebHub
+	// Decoded OSC input, drawn by subscribing to it, and what was drawn
+	bus *Bus
+
+	// Keys of the keyboard tracks
+	tuning *Tuning
+	// Range of the keyboard tracks, the notes if fixed
+	rangePolicy RangePolicy
+	rangeLow    Pitch
+	rangeHigh   Pitch
+	// Only the notes played shown on the keyboard tracks
+	compact bool
+	layout  Layout
+
+	// Cycle-stacked keyboard
+	cycleView bool
+	cycle     Duration
+
+	showLegend bool
+	// Tracks hidden by name
+	hidden      map[string]bool
+	paletteName string
+	themeName   string
+	// Where to save the next frame, if anywhere
+	screenshot string
+
+	// Muted and soloed instruments by track name
+	visibility map[string]*Visibility
+	// Pinned instrument colors by track name
+	pinned        map[string]map[int]color.Color
+	pinnedVersion int
+	// Where the instruments are saved, if anywhere
+	registry *Registry
+	// Screen size from Layout
+	width int
+
+	// Actions to be run on the game loop
+	actions chan func()
+	// Events from the bus to be applied on the game loop
+	events chan Event
+	// Details of the span under the mouse cursor
+	hover *Tooltip
 }
 
 func NewTrosces() *Trosces {
 	log.Printf("Creating new Trosces")
+	switch *splitKeyboard {
+	case "", "side", "stack":
+	default:
+		log.Fatalf("Invalid -split-keyboard: %q", *splitKeyboard)
+	}
+	if !(*drumLoop >= float64(minLength.Beats()) && *drumLoop <= float64(maxLength.Beats())) {
+		log.Fatalf("Invalid -drum-loop: %g, want %g to %g beats", *drumLoop, minLength.Beats(), maxLength.Beats())
+	}
+	if *drumSteps < 1 || *drumSteps > maxDrumSteps {
+		log.Fatalf("Invalid -drum-steps: %d, want 1 to %d", *drumSteps, maxDrumSteps)
+	}
+	if *drumLoops < 1 {
+		log.Fatalf("Invalid -drum-loops: %d, want at least 1", *drumLoops)
+	}
+	if *cycleCount < 1 {
+		log.Fatalf("Invalid -cycles: %d, want at least 1", *cycleCount)
+	}
+	cycle := clampLength(Beats(float32(*cycleBeats)))
+	if float64(cycle.Beats()) != *cycleBeats {
+		log.Printf("Clamped -cycle-beats %g to %g", *cycleBeats, cycle.Beats())
+	}
+
+	pulse := NewPulse(60)
 	trosces := &Trosces{
-		keyboard: &Track{
-			header: NewHeader(15, 30),
-			trail:  NewTrail(Beats(1), Beats(4), 192, 15),
-			mapper: NewMapper(),
-		},
+		keyboard: NewKeyboardTrack(pulse),
 		drums: &Track{
 			header: NewHeader(30, 30),
 			trail:  NewTrail(Beats(1), Beats(4), 192, 30),
@@ -91,129 +308,263 @@ func NewTrosces() *Trosces {
 			mapper: NewMapper(),
 		},
 		variantMappers: map[int]*Mapper{},
+		instruments:    map[int]*Track{},
+		showLegend:     *showLegend,
+		hidden:         map[string]bool{},
+		visibility: map[string]*Visibility{
+			"keyboard": NewVisibility(),
+			"drums":    NewVisibility(),
+		},
+		pinned: map[string]map[int]color.Color{
+			"keyboard": {},
+			"drums":    {},
+		},
+		paletteName: "bright",
+		actions:     make(chan func(), 64),
+		events:      make(chan Event, 1024),
+		cycleView:   *cycleView,
+		cycle:       cycle,
 
-		pulse: NewPulse(60),
+		pulse: pulse,
+	}
+	trosces.setCycle(trosces.keyboard)
+	if tuning, err := LoadTuning(*tuningFlag, *kbmFlag); err != nil {
+		log.Fatalf("Invalid -tuning or -kbm: %v", err)
+	} else {
+		trosces.tuning = tuning
+		trosces.keyboard.SetTuning(tuning)
+	}
+	if policy, low, high, err := ParseRange(*keyboardRange); err != nil {
+		log.Fatalf("Invalid -range: %v", err)
+	} else {
+		trosces.SetKeyboardRange(policy, low, high)
+	}
+	trosces.SetCompact(*compactKeyboard)
+	if layout, err := ParseLayout(*keyboardLayout); err != nil {
+		log.Fatalf("Invalid -layout: %v", err)
+	} else {
+		trosces.SetLayout(layout)
+	}
+	if t, err := LoadTheme(*themeFlag); err != nil {
+		log.Fatalf("Invalid -theme: %v", err)
+	} else {
+		trosces.SetTheme(*themeFlag, t)
+	}
+	trosces.loadRegistry()
+	trosces.bus = NewBus()
+	// Dropping rather than holding up the OSC input when the game loop stalls
+	trosces.bus.Subscribe("tracks", trosces, 1024, DropOldest)
+
+	if *cueAddr != "" {
+		cue, err := NewCue(*cueAddr)
+		if err != nil {
+			log.Fatalf("Invalid -cue-addr: %v", err)
+		}
+		trosces.cue = cue
+	}
+	if *httpAddr != "" {
+		trosces.web = NewWebHub(trosces.webSnapshot)
+		trosces.bus.Subscribe("web", trosces.web, 1024, DropNewest)
 	}
-	trosces.keyboard.header.keyboard = true
 	trosces.drums.header.borderWidth = 2
 	trosces.drums.trail.borderWidth = 2
 	trosces.layers.header.borderWidth = 2
 	trosces.layers.trail.borderWidth = 2
 
-	trosces.keyboard.trail.pulse = trosces.pulse
 	trosces.drums.trail.pulse = trosces.pulse
+	trosces.drums.stepGrid = NewStepGrid(trosces.drums.trail, Beats(float32(*drumLoop)), *drumSteps, *drumLoops)
+	trosces.drums.showStepGrid = *drumGrid
 	trosces.layers.trail.pulse = trosces.pulse
+	trosces.layers.trail.labeler = trosces.variantName
+	trosces.layers.trail.SetShowLabels(*variantLabels)
 
 	return trosces
 }
 
-// Events from OSC.
+// Keyboard track for the instrument, created on the fly when split.
+func (trosces *Trosces) keyboardTrack(iNum int, create bool) *Track {
+	if *splitKeyboard == "" {
+		return trosces.keyboard
+	}
+
+	track, ok := trosces.instruments[iNum]
+	if !ok && create {
+		log.Printf("New keyboard track for instrument %d", iNum)
+		track = NewKeyboardTrack(trosces.pulse)
+		track.mapper = trosces.keyboard.mapper
+		track.header.SetHighlight(trosces.highlight)
+		track.trail.SetGridSteps(trosces.keyboard.trail.gridSteps)
+		track.trail.SetLength(trosces.keyboard.trail.length)
+		trosces.setCycle(track)
+		track.SetTuning(trosces.tuning)
+		low, _ := trosces.tuning.Key(trosces.rangeLow)
+		high, _ := trosces.tuning.Key(trosces.rangeHigh)
+		track.trail.SetRangePolicy(trosces.rangePolicy, low, high)
+		track.trail.SetCompact(trosces.compact, *compactHighlight)
+		track.trail.SetLayout(trosces.layout)
+		trosces.visibility["keyboard"].Apply(track.trail)
+		track.trail.SetColors(trosces.pinnedColors("keyboard"))
+		trosces.instruments[iNum] = track
+	}
+	return track
+}
+
+func (trosces *Trosces) setCycle(track *Track) {
+	track.trail.SetCycle(trosces.cycle, *cycleCount)
+	track.trail.SetCycleView(trosces.cycleView)
+}
+
+// All the keyboard tracks to be shown, in the order of the instruments.
+func (trosces *Trosces) keyboardTracks() []*Track {
+	if len(trosces.instruments) == 0 {
+		return []*Track{trosces.keyboard}
+	}
+	ids := make([]int, 0, len(trosces.instruments))
+	for iNum := range trosces.instruments {
+		ids = append(ids, iNum)
+	}
+	mapper := trosces.keyboard.mapper
+	sort.Slice(ids, func(i, j int) bool { return mapper.Pos(ids[i]) < mapper.Pos(ids[j]) })
+	tracks := make([]*Track, len(ids))
+	for i, iNum := range ids {
+		tracks[i] = trosces.instruments[iNum]
+	}
+	return tracks
+}
+
+// Events from the bus.
 
-func (trosces *Trosces) PlayNote(instrument string, note Note, duration Duration) {
+func (trosces *Trosces) PlayNote(instrument string, pitch Pitch, start Time, duration Duration, velocity float32) {
 	iNum := trosces.keyboard.mapper.Get(instrument)
 	if duration.IsZero() {
 		duration = Forever()
 	}
-	trosces.keyboard.trail.Span(iNum, int(note), duration)
+	key, cents := trosces.tuning.Key(pitch)
+	span := trosces.keyboardTrack(iNum, true).trail.DetunedSpan(iNum, key, cents, start, duration, velocity)
+	trosces.publish(trosces.spanEvent("keyboard", span))
 }
 
 func (trosces *Trosces) SetHighlight(notes []int) {
+	trosces.highlight = notes
+
 	trosces.keyboard.header.SetHighlight(notes)
+	if *splitKeyboard != "" {
+		for _, track := range trosces.keyboardTracks() {
+			track.header.SetHighlight(notes)
+		}
+	}
+	trosces.publish(&WebEvent{Type: "highlight", Highlight: notes})
 }
 
-func (trosces *Trosces) StopNote(instrument string, note Note) {
+func (trosces *Trosces) StopNote(instrument string, pitch Pitch, end Time) {
 	iNum := trosces.keyboard.mapper.Get(instrument)
-	trosces.keyboard.trail.Stop(iNum, int(note))
+	key, _ := trosces.tuning.Key(pitch)
+	if track := trosces.keyboardTrack(iNum, false); track != nil {
+		if track.trail.Stop(iNum, key, end) {
+			trosces.publish(trosces.stopEvent("keyboard", iNum, key, end))
+		}
+	}
 }
 
-func (trosces *Trosces) PlayDrum(instrument string, duration Duration) {
+func (trosces *Trosces) PlayDrum(instrument string, start Time, duration Duration, velocity float32) {
 	iNum := trosces.drums.mapper.Get(instrument)
 	if duration.IsZero() {
 		duration = Beats(1.0 / 8)
 	}
-	trosces.drums.trail.Span(iNum, iNum, duration)
+	span := trosces.drums.trail.DetunedSpan(iNum, trosces.drums.mapper.Pos(iNum), 0, start, duration, velocity)
+	trosces.publish(trosces.spanEvent("drums", span))
 }
 
-func (trosces *Trosces) PlayLayer(name string, duration Duration, variant string) {
+func (trosces *Trosces) PlayLayer(name string, start Time, duration Duration, variant string) {
 	lNum := trosces.layers.mapper.Get(name)
-	if _, ok := trosces.variantMappers[lNum]; !ok {
-		trosces.variantMappers[lNum] = NewMapper()
-	}
-	vNum := trosces.variantMappers[lNum].Get(variant)
-	trosces.layers.trail.Span(vNum, lNum, duration)
+	vNum := trosces.variantMapper(lNum).Get(variant)
+	span := trosces.layers.trail.DetunedSpan(vNum, trosces.layers.mapper.Pos(lNum), 0, start, duration, 1)
+	trosces.publish(trosces.spanEvent("layers", span))
 }
 
-func (trosces *Trosces) Sync(bpm int) {
-	trosces.pulse.Sync(float32(bpm))
-}
-
-// Implements ebiten.Game interface.
-
-func (trosces *Trosces) Update() error {
-	_, task := trace.NewTask(context.Background(), "UpdateTrosces")
-	defer task.End()
-
-	// Header matches the trail.
-	trosces.keyboard.Resolve()
-	trosces.drums.Resolve()
-	trosces.layers.Resolve()
-
-	// Grid steps
-	if inpututil.IsKeyJustPressed(ebiten.Key3) {
-		trosces.keyboard.trail.SetGridSteps(3)
-		trosces.drums.trail.SetGridSteps(3)
+// Register the instrument ahead of playing, with any of the properties given:
+// a pinned color, a display name and its order among the pads, layers or
+// split keyboards, -1 if not given. The track is only where it is looked up,
+// and the instrument is still played with the events of that track.
+func (trosces *Trosces) DeclareInstrument(track string, name string, c color.Color, label string, order int) {
+	tracks, err := trosces.namedTracks(track)
+	if err != nil {
+		log.Printf("Invalid instrument track: %v", err)
+		return
 	}
-	if inpututil.IsKeyJustPressed(ebiten.Key4) {
-		trosces.keyboard.trail.SetGridSteps(4)
-		trosces.drums.trail.SetGridSteps(4)
+	mapper := tracks[0].mapper
+	id := mapper.Get(name)
+	if label != "" {
+		mapper.SetLabel(id, label)
 	}
-
-	// Freeze
-	if inpututil.IsKeyJustPressed(ebiten.KeySpace) {
-		trosces.pulse.ToggleFrozen()
+	if c != nil {
+		trosces.PinColor(track, id, c)
 	}
-
-	// Maybe finish.
-	if inpututil.IsKeyJustPressed(ebiten.KeyQ) || inpututil.IsKeyJustPressed(ebiten.KeyEscape) {
-		return Finished
+	if count := len(mapper.Names()); order >= count {
+		log.Printf("Invalid order of %s: %d, want below %d", name, order, count)
+	} else if order >= 0 && order != mapper.Pos(id) {
+		old := mapper.Move(id, order)
+		if track != "keyboard" {
+			// Spans are placed by position rather than by note
+			for _, t := range tracks {
+				t.trail.SwapPositions(old, order)
+			}
+		}
 	}
+}
 
-	return nil
+func (trosces *Trosces) variantMapper(lNum int) *Mapper {
+	if _, ok := trosces.variantMappers[lNum]; !ok {
+		trosces.variantMappers[lNum] = NewMapper()
+	}
+	return trosces.variantMappers[lNum]
 }
 
-func (trosces *Trosces) Draw(screen *ebiten.Image) {
-	ctx, task := trace.NewTask(context.Background(), "DrawTrosces")
-	defer task.End()
+// Label for layer spans.
+func (trosces *Trosces) variantName(span *Span) string {
+	lNum, _ := trosces.layers.mapper.IdAt(span.pos)
+	return trosces.variantMapper(lNum).Label(span.id)
+}
 
-	var x float64
-	op := ebiten.DrawImageOptions{}
-	trosces.keyboard.Draw(ctx, screen, &op)
-	x += float64(trosces.keyboard.Width())
+func (trosces *Trosces) Sync(bpm int, at time.Time) {
+	trosces.pulse.Sync(float32(bpm), at)
+	event := trosces.pulseEvent()
+	event.Type = "sync"
+	trosces.publish(event)
+}
 
-	op = ebiten.DrawImageOptions{}
-	op.GeoM.Translate(x, 0)
-	trosces.drums.Draw(ctx, screen, &op)
-	x += float64(trosces.drums.Width())
+// Track at its position on the screen.
+type Placement struct {
+	track *Track
+	x, y  float32
+}
 
-	op = ebiten.DrawImageOptions{}
-	op.GeoM.Translate(x, 0)
-	trosces.layers.Draw(ctx, screen, &op)
-	x += float64(trosces.layers.Width())
+// Where all the tracks are drawn: keyboards, drums and layers left to right.
+func (trosces *Trosces) placements() []Placement {
+	var placements []Placement
+	var x, y float32
+	if !trosces.hidden["keyboard"] {
+		for _, track := range trosces.keyboardTracks() {
+			if *splitKeyboard == "stack" {
+				placements = append(placements, Placement{track: track, x: 0, y: y})
+				y += track.Height()
+				if width := track.Width(); width > x {
+					x = width
+				}
+			} else {
+				placements = append(placements, Placement{track: track, x: x, y: 0})
+				x += track.Width()
+			}
+		}
+	}
 
-	// TODO: Actually don't draw the extra pixels above!
-	path := vector.Path{}
-	line := trosces.keyboard.header.keyHeight + trosces.keyboard.trail.length.Beats()*trosces.keyboard.trail.beatSize
-	path.MoveTo(0, line)
-	path.LineTo(float32(x), line)
-	path.LineTo(float32(x), line+256)
-	path.LineTo(0, line+256)
-	path.Fill(screen, &vector.FillOptions{Color: color.Black})
-}
+	if !trosces.hidden["drums"] {
+		placements = append(placements, Placement{track: trosces.drums, x: x, y: 0})
+		x += trosces.drums.Width()
+	}
 
-func (trosces *Trosces) Layout(outsideWidth, outsideHeight int) (int, int) {
-	height := float32(outsideHeight) - trosces.keyboard.header.keyHeight
-	trosces.keyboard.trail.SetBeatSize(height / 4)
-	trosces.drums.trail.SetBeatSize(height / 4)
-	trosces.layers.trail.SetBeatSize(height / 128)
-	return outsideWidth, outsideHeight
+	if !trosces.hidden["layers"] {
+		placements = append(placements, Placement{track: trosces.layers, x: x, y: 0})
+	}
+	return placements
 }
@@ -0,0 +1,262 @@
+//go:build tui
+// +build tui
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Piano roll of the keyboard and drum trails drawn with ANSI escapes. Each
+// character cell stacks two moments using the upper half block.
+type TUI struct {
+	trosces *Trosces
+	out     *bufio.Writer
+	// Key presses read from the terminal
+	keys chan byte
+}
+
+func NewTUI(trosces *Trosces) *TUI {
+	return &TUI{
+		trosces: trosces,
+		out:     bufio.NewWriter(os.Stdout),
+		keys:    make(chan byte, 16),
+	}
+}
+
+// Run until quit.
+func (tui *TUI) Run() error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("stdin is not a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	// Logs would garble the screen, unless going elsewhere
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	// Alternate screen without a cursor, restored on the way out
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(os.Stdout, "\x1b[0m\x1b[?25h\x1b[?1049l")
+
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				log.Printf("Failed to read terminal input: %v", err)
+				close(tui.keys)
+				return
+			}
+			tui.keys <- buf[0]
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second / 30)
+	defer ticker.Stop()
+	for {
+		select {
+		case key, ok := <-tui.keys:
+			if !ok || tui.handleKey(key) {
+				return nil
+			}
+		case <-ticker.C:
+			tui.trosces.applyPending()
+			width, height, err := term.GetSize(int(os.Stdout.Fd()))
+			if err != nil {
+				return err
+			}
+			tui.draw(width, height)
+		}
+	}
+}
+
+// Same hotkeys as the window, returns whether to quit.
+func (tui *TUI) handleKey(key byte) bool {
+	trosces := tui.trosces
+	defaultTracks, _ := trosces.tracksOrDefault("")
+	switch key {
+	case ' ':
+		trosces.pulse.ToggleFrozen()
+	case '3', '4':
+		trosces.SetGridSteps(int(key-'0'), defaultTracks)
+	case '-':
+		trosces.SetLength(Beats(trosces.keyboard.trail.length.Beats()*2), defaultTracks)
+	case '=':
+		if trosces.keyboard.trail.length.Beats() > 1 {
+			trosces.SetLength(Beats(trosces.keyboard.trail.length.Beats()/2), defaultTracks)
+		}
+	case 0x7f, 0x08:
+		// Backspace
+		for _, name := range trackNames {
+			tracks, _ := trosces.namedTracks(name)
+			trosces.Clear(tracks)
+		}
+	case 'q', 'Q', 0x03:
+		// Or Ctrl+C, Escape starts the sequences of other keys
+		return true
+	}
+	return false
+}
+
+// Color of each half-row cell of the trail, newest at the top.
+func (tui *TUI) trailCells(trail *Trail, rows int, highlight map[int]bool) [][]color.RGBA {
+	columns := trail.columns
+	now := trail.pulse.Horizon()
+	slice := trail.length.Beats() / float32(rows)
+	stepSize := 1 / float32(trail.gridSteps)
+	highlighted := map[int]bool{}
+	for pos := range highlight {
+		if column, ok := columns.Of(pos); ok {
+			highlighted[column] = true
+		}
+	}
+
+	cells := make([][]color.RGBA, rows)
+	for row := range cells {
+		cells[row] = make([]color.RGBA, columns.Count())
+		newer := now.Sub(Beats(float32(row) * slice))
+		older := now.Sub(Beats(float32(row+1) * slice))
+		// Grid line falling within the slice
+		onGrid := newer.Truncate(Beats(stepSize)).After(older)
+		for i := range cells[row] {
+			pos, _ := columns.At(i)
+			var c color.Color
+			switch {
+			case onGrid && trail.tuning.IsRepeat(pos):
+				c = theme.OctaveLine
+			case onGrid:
+				c = theme.GridLine
+			case len(highlight) > 0 && !highlighted[i]:
+				c = theme.DimmedColumn
+			case trail.tuning.IsWhite(pos):
+				c = theme.WhiteColumn
+			default:
+				c = theme.BlackColumn
+			}
+			cells[row][i] = color.RGBAModel.Convert(c).(color.RGBA)
+		}
+	}
+
+	// Spans on top, later ones over earlier ones
+	for _, span := range trail.VisibleSpans(now.Sub(trail.length), now) {
+		c := color.RGBAModel.Convert(trail.SpanColor(span.id)).(color.RGBA)
+		for row := range cells {
+			newer := now.Sub(Beats(float32(row) * slice))
+			older := now.Sub(Beats(float32(row+1) * slice))
+			if column, ok := columns.Of(span.pos); ok && span.start.Before(newer) && span.end.After(older) {
+				cells[row][column] = c
+			}
+		}
+	}
+	return cells
+}
+
+func (tui *TUI) draw(width, height int) {
+	trosces := tui.trosces
+	out := tui.out
+
+	highlight := map[int]bool{}
+	for _, pos := range trosces.highlight {
+		highlight[pos] = true
+	}
+
+	// A status line, the rest split in two moments per line
+	lines := height - 1
+	if lines < 1 {
+		return
+	}
+	var columns [][][]color.RGBA
+	for _, track := range trosces.keyboardTracks() {
+		columns = append(columns, tui.trailCells(track.trail, 2*lines, highlight))
+	}
+	columns = append(columns, tui.trailCells(trosces.drums.trail, 2*lines, nil))
+
+	fmt.Fprint(out, "\x1b[H")
+	now := trosces.pulse.Horizon()
+	status := fmt.Sprintf("beat %.1f  %.0f bpm  %g beats shown", now.Beat(), trosces.pulse.bpm, trosces.keyboard.trail.length.Beats())
+	if trosces.pulse.IsFrozen() {
+		status += "  frozen"
+	}
+	if len(status) > width {
+		status = status[:width]
+	}
+	fmt.Fprintf(out, "\x1b[0m%s\x1b[K\r\n", status)
+
+	for line := 0; line < lines; line++ {
+		used := 0
+		for i, cells := range columns {
+			if i > 0 && used < width {
+				// Gap between tracks
+				fmt.Fprint(out, "\x1b[0m ")
+				used++
+			}
+			upper, lower := cells[2*line], cells[2*line+1]
+			for pos := range upper {
+				if used >= width {
+					break
+				}
+				u, l := upper[pos], lower[pos]
+				fmt.Fprintf(out, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", u.R, u.G, u.B, l.R, l.G, l.B)
+				used++
+			}
+		}
+		fmt.Fprint(out, "\x1b[0m\x1b[K")
+		if line < lines-1 {
+			fmt.Fprint(out, "\r\n")
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Printf("Failed to draw to the terminal: %v", err)
+	}
+}
+
+// Drawn in the terminal rather than a window.
+const terminalBuild = true
+
+// Show the trosces in the terminal until quit.
+func run(trosces *Trosces) error {
+	if err := NewTUI(trosces).Run(); err != nil {
+		return fmt.Errorf("failed to run in the terminal: %v", err)
+	}
+	return nil
+}
+
+// No images to keep for the terminal.
+type trailImages struct{}
+
+func newTrailImages() trailImages {
+	return trailImages{}
+}
+
+func (trail *Trail) redrawBucket(bucketTime Time) {}
+
+func (trail *Trail) redrawAll() {}
+
+func (trail *Trail) resetAll() {}
+
+func (trail *Trail) releaseImages(before Time) {}
+
+func (trail *Trail) imageCounts() (int, int) {
+	return 0, 0
+}
+
+type headerImages struct{}
+
+func (header *Header) resetImages() {
+	header.overlayReady = false
+}
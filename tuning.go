@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	tuningFlag = flag.String("tuning", "12edo", "Keys of the keyboard: equal divisions of the octave like \"12edo\" or \"31edo\", or a Scala .scl file")
+	kbmFlag    = flag.String("kbm", "", "Scala .kbm file mapping the -tuning scale to the keys, by default the first degree is C4 at 261.63Hz")
+)
+
+// Pitches of the keyboard keys, from a scale repeating every period and a
+// mapping of its degrees to the keys.
+type Tuning struct {
+	name string
+	// Cents of the degrees above the first, the period (e.g. 1200 for an
+	// octave) last
+	scale []float64
+	// Key of the first entry of the mapping
+	middle int
+	// Degree of the scale for each key of the mapping, -1 if not mapped
+	mapping []int
+	// Degree the mapping repeats at
+	octaveDegree int
+	// Pitch of the middle key
+	origin Pitch
+}
+
+// The usual tuning, a key for each note.
+var equalTemperament = NewEqualTuning(12)
+
+// The octave divided into n equal steps.
+func NewEqualTuning(n int) *Tuning {
+	scale := make([]float64, n)
+	for i := range scale {
+		scale[i] = float64(i+1) * 1200 / float64(n)
+	}
+	return newTuning(fmt.Sprintf("%dedo", n), scale)
+}
+
+// With the first degree on C4, and the degrees on the keys in order.
+func newTuning(name string, scale []float64) *Tuning {
+	tuning := &Tuning{
+		name:         name,
+		scale:        scale,
+		middle:       48,
+		mapping:      make([]int, len(scale)),
+		octaveDegree: len(scale),
+		origin:       48,
+	}
+	for i := range tuning.mapping {
+		tuning.mapping[i] = i
+	}
+	return tuning
+}
+
+var edoPattern = regexp.MustCompile(`^([0-9]+)edo$`)
+
+// Tuning of the -tuning and -kbm flags.
+func LoadTuning(name string, kbmPath string) (*Tuning, error) {
+	if name == equalTemperament.name && kbmPath == "" {
+		return equalTemperament, nil
+	}
+	var tuning *Tuning
+	if match := edoPattern.FindStringSubmatch(name); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		if n < 1 || n > 1200 {
+			return nil, fmt.Errorf("%d divisions of the octave, expected 1 to 1200", n)
+		}
+		tuning = NewEqualTuning(n)
+	} else {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		scale, err := ParseScala(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		tuning = newTuning(name, scale)
+	}
+	if kbmPath != "" {
+		data, err := ioutil.ReadFile(kbmPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := tuning.ParseMapping(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", kbmPath, err)
+		}
+	}
+	return tuning, nil
+}
+
+// Values of a Scala file, skipping the comments.
+func scalaLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if !strings.HasPrefix(line, "!") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Cents of the degrees of a .scl file, the period last.
+func ParseScala(data []byte) ([]float64, error) {
+	lines := scalaLines(data)
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("expected a description and the number of notes")
+	}
+	// First the description, which may be anything
+	count, err := strconv.Atoi(firstField(lines[1]))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid number of notes %q", lines[1])
+	}
+	if len(lines)-2 < count {
+		return nil, fmt.Errorf("expected %d notes, got %d", count, len(lines)-2)
+	}
+	scale := make([]float64, count)
+	for i, line := range lines[2 : 2+count] {
+		value := firstField(line)
+		var cents float64
+		if strings.Contains(value, ".") {
+			cents, err = strconv.ParseFloat(value, 64)
+		} else {
+			cents, err = ratioCents(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid note %d %q: %v", i+1, value, err)
+		}
+		if i > 0 && cents <= scale[i-1] || cents <= 0 {
+			return nil, fmt.Errorf("note %d %q not above the one before", i+1, value)
+		}
+		scale[i] = cents
+	}
+	return scale, nil
+}
+
+func firstField(line string) string {
+	if fields := strings.Fields(line); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// Cents of a ratio like "3/2", or "2".
+func ratioCents(value string) (float64, error) {
+	parts := strings.SplitN(value, "/", 2)
+	numerator, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	denominator := 1.0
+	if len(parts) == 2 {
+		if denominator, err = strconv.ParseFloat(parts[1], 64); err != nil {
+			return 0, err
+		}
+	}
+	if numerator <= 0 || denominator <= 0 {
+		return 0, fmt.Errorf("not a positive ratio")
+	}
+	return 1200 * math.Log2(numerator/denominator), nil
+}
+
+// Map the degrees to the keys as in a .kbm file. The first and last notes
+// to retune are not used, all the keys follow the mapping.
+func (tuning *Tuning) ParseMapping(data []byte) error {
+	lines := scalaLines(data)
+	if len(lines) < 7 {
+		return fmt.Errorf("expected at least 7 values, got %d", len(lines))
+	}
+	values := make([]int, 7)
+	for i, name := range []string{"map size", "first note", "last note", "middle note", "reference note", "", "octave degree"} {
+		if name == "" {
+			continue
+		}
+		var err error
+		if values[i], err = strconv.Atoi(firstField(lines[i])); err != nil {
+			return fmt.Errorf("invalid %s %q", name, lines[i])
+		}
+	}
+	frequency, err := strconv.ParseFloat(firstField(lines[5]), 64)
+	if err != nil || frequency <= 0 {
+		return fmt.Errorf("invalid reference frequency %q", lines[5])
+	}
+	size, octaveDegree := values[0], values[6]
+
+	var mapping []int
+	if size == 0 {
+		// The degrees in order
+		mapping = make([]int, len(tuning.scale))
+		for i := range mapping {
+			mapping[i] = i
+		}
+		octaveDegree = len(tuning.scale)
+	} else {
+		if size < 0 || len(lines)-7 < size {
+			return fmt.Errorf("expected %d keys mapped, got %d", size, len(lines)-7)
+		}
+		for i, line := range lines[7 : 7+size] {
+			value := firstField(line)
+			degree := -1
+			if value != "x" {
+				if degree, err = strconv.Atoi(value); err != nil || degree < 0 {
+					return fmt.Errorf("invalid degree %q of key %d", value, i)
+				}
+			}
+			mapping = append(mapping, degree)
+		}
+	}
+	if octaveDegree < 1 {
+		return fmt.Errorf("invalid octave degree %d", octaveDegree)
+	}
+
+	// MIDI keys count from C-1, notes from C0
+	tuning.middle = values[3] - 12
+	tuning.mapping = mapping
+	tuning.octaveDegree = octaveDegree
+	tuning.origin = 0
+	reference, ok := tuning.KeyPitch(values[4] - 12)
+	if !ok {
+		return fmt.Errorf("reference note %d not mapped", values[4])
+	}
+	tuning.origin = FrequencyPitch(frequency) - reference
+	return nil
+}
+
+// Keys in each repeat of the mapping, e.g. 12 for an octave.
+func (tuning *Tuning) Keys() int {
+	return len(tuning.mapping)
+}
+
+// Cents of the degree above the first, beyond the period too.
+func (tuning *Tuning) degreeCents(degree int) float64 {
+	n := len(tuning.scale)
+	period := floorDiv(degree, n)
+	cents := tuning.scale[n-1] * float64(period)
+	if step := degree - period*n; step > 0 {
+		cents += tuning.scale[step-1]
+	}
+	return cents
+}
+
+// Pitch of the key, if mapped to a degree.
+func (tuning *Tuning) KeyPitch(key int) (Pitch, bool) {
+	offset := key - tuning.middle
+	repeat := floorDiv(offset, tuning.Keys())
+	degree := tuning.mapping[offset-repeat*tuning.Keys()]
+	if degree < 0 {
+		return 0, false
+	}
+	cents := tuning.degreeCents(degree) + float64(repeat)*tuning.degreeCents(tuning.octaveDegree)
+	return tuning.origin + Pitch(cents/100), true
+}
+
+// Key nearest to the pitch, and the cents the pitch is off it.
+func (tuning *Tuning) Key(pitch Pitch) (int, float64) {
+	repeatCents := tuning.degreeCents(tuning.octaveDegree)
+	keys := tuning.Keys()
+	guess := tuning.middle + int(math.Round(float64(pitch-tuning.origin)*100/repeatCents*float64(keys)))
+	best, bestCents := guess, math.Inf(1)
+	for key := guess - keys - 1; key <= guess+keys+1; key++ {
+		if keyPitch, ok := tuning.KeyPitch(key); ok {
+			if cents := float64(pitch-keyPitch) * 100; math.Abs(cents) < math.Abs(bestCents) {
+				best, bestCents = key, cents
+			}
+		}
+	}
+	return best, bestCents
+}
+
+// Position of the key within the repeat of the mapping, like C to B.
+func (tuning *Tuning) Degree(key int) int {
+	return floorMod(key-tuning.middle, tuning.Keys())
+}
+
+// Keys nearest to the white notes are white.
+func (tuning *Tuning) IsWhite(key int) bool {
+	if tuning == equalTemperament {
+		return Note(key).IsWhite()
+	}
+	pitch, ok := tuning.KeyPitch(key)
+	if !ok {
+		return false
+	}
+	note := Note(math.Round(float64(pitch)))
+	if !note.IsWhite() {
+		return false
+	}
+	nearest, _ := tuning.Key(Pitch(note))
+	return nearest == key
+}
+
+// Whether the key starts a repeat of the mapping, like C starts an octave.
+func (tuning *Tuning) IsRepeat(key int) bool {
+	return tuning.Degree(key) == 0
+}
+
+// Name of the key, like "C4" or "C4+39c".
+func (tuning *Tuning) Name(key int) string {
+	if tuning == equalTemperament {
+		return Note(key).String()
+	}
+	if pitch, ok := tuning.KeyPitch(key); ok {
+		return pitch.String()
+	}
+	return "x"
+}
+
+// Name of the key regardless of the repeat, like "C#", or the degree.
+func (tuning *Tuning) DegreeName(key int) string {
+	if tuning == equalTemperament {
+		return Note(key).PitchName()
+	}
+	return strconv.Itoa(tuning.Degree(key))
+}
+
+// Key as sent to the host: a name like "cs4" understood by NewNote and Sonic
+// Pi, or the MIDI note number if microtonal.
+func (tuning *Tuning) Symbol(key int) string {
+	if tuning == equalTemperament {
+		return Note(key).Symbol()
+	}
+	pitch, _ := tuning.KeyPitch(key)
+	return strconv.FormatFloat(pitch.MIDI(), 'f', 2, 64)
+}
+
+// Keys in the step nearest to a perfect fifth, if it goes through all of
+// them before repeating, else 1.
+func (tuning *Tuning) Fifth() int {
+	keys := tuning.Keys()
+	base, _ := tuning.KeyPitch(tuning.middle)
+	best, bestCents := 1, math.Inf(1)
+	for step := 1; step < keys; step++ {
+		pitch, ok := tuning.KeyPitch(tuning.middle + step)
+		if !ok {
+			continue
+		}
+		if cents := math.Abs(float64(pitch-base)*100 - 701.955); cents < bestCents {
+			best, bestCents = step, cents
+		}
+	}
+	if gcd(best, keys) != 1 {
+		return 1
+	}
+	return best
+}
+
+// Fraction of the way to the next key up or down the pitch is off its key by
+// the cents.
+func (tuning *Tuning) keyFraction(key int, cents float64) float64 {
+	if cents == 0 {
+		return 0
+	}
+	pitch, ok := tuning.KeyPitch(key)
+	next, nextOk := tuning.KeyPitch(key + 1)
+	if cents < 0 {
+		next, nextOk = tuning.KeyPitch(key - 1)
+	}
+	if !ok || !nextOk || next == pitch {
+		return 0
+	}
+	return cents / math.Abs(float64(next-pitch)*100)
+}
+
+func floorDiv(a int, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
+}
+
+func floorMod(a int, b int) int {
+	return a - floorDiv(a, b)*b
+}
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Nearest keys of the pitches.
+func (tuning *Tuning) KeysOf(pitches []Pitch) []int {
+	keys := make([]int, len(pitches))
+	for i, pitch := range pitches {
+		keys[i], _ = tuning.Key(pitch)
+	}
+	return keys
+}
+
+// Lay the keys out by the tuning, growing the range by its repeats.
+func (trail *Trail) SetTuning(tuning *Tuning) {
+	trail.tuning = tuning
+	trail.rangeAlign = tuning.Keys()
+	trail.updateColumns()
+	trail.redrawAll()
+}
+
+// Key the keyboard track by the tuning.
+func (track *Track) SetTuning(tuning *Tuning) {
+	track.header.tuning = tuning
+	track.header.Redraw()
+	track.trail.SetTuning(tuning)
+}
+
+// Pitch the span was played at.
+func (trail *Trail) SpanPitch(span *Span) Pitch {
+	pitch, _ := trail.tuning.KeyPitch(span.pos)
+	return pitch + Pitch(span.cents/100)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewPitch(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want Pitch
+	}{
+		{"c4", 48},
+		{"c4+25c", 48.25},
+		{"eb3-13.5c", 39 - 0.135},
+		{"c5-10c", 59.9},
+		{"440hz", 57},
+		{"60.5", 48.5},
+	} {
+		got, err := NewPitch(tc.s)
+		if err != nil || math.Abs(float64(got-tc.want)) > 1e-9 {
+			t.Errorf("%s: got %v, %v, want %v", tc.s, float64(got), err, float64(tc.want))
+		}
+	}
+	for _, s := range []string{"c4+25", "nanhz", "infhz", "-inf", "NaN", "128", "-1", "1e9hz"} {
+		if _, err := NewPitch(s); err == nil {
+			t.Errorf("%s: want an error", s)
+		}
+	}
+	if got := Pitch(48.25).String(); got != "C4+25c" {
+		t.Errorf("got %q, want C4+25c", got)
+	}
+}
+
+func TestEqualTuning(t *testing.T) {
+	tuning := NewEqualTuning(31)
+	// A quarter tone above C4 is nearest to the first step of 31
+	key, cents := tuning.Key(48.5)
+	if key != 49 || math.Abs(cents-(50-1200.0/31)) > 1e-6 {
+		t.Errorf("got key %d %.2fc off, want 49", key, cents)
+	}
+	var white int
+	for key := 48; key < 48+31; key++ {
+		if tuning.IsWhite(key) {
+			white++
+		}
+	}
+	if white != 7 {
+		t.Errorf("got %d white keys in an octave, want 7", white)
+	}
+	if fifth := tuning.Fifth(); fifth != 18 {
+		t.Errorf("got a fifth of %d steps, want 18", fifth)
+	}
+}
+
+func TestScala(t *testing.T) {
+	scale, err := ParseScala([]byte(`! just.scl
+!
+Just major
+ 7
+!
+9/8
+5/4
+4/3
+3/2
+5/3
+15/8
+2/1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuning := newTuning("just", scale)
+	// White keys only, with A4 at 440Hz
+	err = tuning.ParseMapping([]byte(`! white.kbm
+12
+0
+127
+60
+69
+440.0
+7
+! C to B
+0
+x
+1
+x
+2
+3
+x
+4
+x
+5
+x
+6
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pitch, ok := tuning.KeyPitch(57); !ok || math.Abs(float64(pitch-57)) > 1e-9 {
+		t.Errorf("got A4 at %v, want 57", float64(pitch))
+	}
+	// C is 16 cents sharp below the A, its just major third 14 cents flat
+	if pitch, ok := tuning.KeyPitch(64); !ok || math.Abs(float64(pitch-64)-0.0196) > 1e-3 {
+		t.Errorf("got E5 at %v, want 64.02", float64(pitch))
+	}
+	if _, ok := tuning.KeyPitch(49); ok {
+		t.Errorf("got a pitch for an unmapped key")
+	}
+	if key, _ := tuning.Key(49); key != 48 && key != 50 {
+		t.Errorf("got key %d for C#4, want a mapped neighbour", key)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+
+	"github.com/hypebeast/go-osc/osc"
+)
+
+// Muted and soloed instruments of a track, by ID. Hidden instruments are
+// neither drawn nor take up room from others, but their spans are kept.
+type Visibility struct {
+	muted  map[int]bool
+	soloed map[int]bool
+}
+
+func NewVisibility() *Visibility {
+	return &Visibility{
+		muted:  map[int]bool{},
+		soloed: map[int]bool{},
+	}
+}
+
+func (v *Visibility) Apply(trail *Trail) {
+	muted := make(map[int]bool, len(v.muted))
+	for id := range v.muted {
+		muted[id] = true
+	}
+	soloed := make(map[int]bool, len(v.soloed))
+	for id := range v.soloed {
+		soloed[id] = true
+	}
+	trail.SetVisibility(muted, soloed)
+}
+
+func (trosces *Trosces) applyVisibility(track string) {
+	tracks, err := trosces.namedTracks(track)
+	if err != nil {
+		log.Printf("Invalid visibility track: %v", err)
+		return
+	}
+	for _, t := range tracks {
+		trosces.visibility[track].Apply(t.trail)
+	}
+}
+
+func (trosces *Trosces) ToggleMuted(track string, id int) {
+	v := trosces.visibility[track]
+	if v.muted[id] {
+		delete(v.muted, id)
+	} else {
+		v.muted[id] = true
+	}
+	trosces.applyVisibility(track)
+}
+
+func (trosces *Trosces) ToggleSoloed(track string, id int) {
+	v := trosces.visibility[track]
+	if v.soloed[id] {
+		delete(v.soloed, id)
+	} else {
+		v.soloed[id] = true
+	}
+	trosces.applyVisibility(track)
+}
+
+func (trosces *Trosces) SetMuted(track string, ids []int) {
+	v := trosces.visibility[track]
+	v.muted = map[int]bool{}
+	for _, id := range ids {
+		v.muted[id] = true
+	}
+	trosces.applyVisibility(track)
+}
+
+func (trosces *Trosces) SetSoloed(track string, ids []int) {
+	v := trosces.visibility[track]
+	v.soloed = map[int]bool{}
+	for _, id := range ids {
+		v.soloed[id] = true
+	}
+	trosces.applyVisibility(track)
+}
+
+// Solo the instruments one after another, then none.
+func (trosces *Trosces) SoloNext(track string) {
+	tracks, _ := trosces.namedTracks(track)
+
+	last := -1
+	for id := range trosces.visibility[track].soloed {
+		if id > last {
+			last = id
+		}
+	}
+	for _, id := range tracks[0].mapper.SortedIds() {
+		if id > last {
+			trosces.SetSoloed(track, []int{id})
+			return
+		}
+	}
+	trosces.SetSoloed(track, nil)
+}
+
+func addVisibilityHandlers(d *countingDispatcher, trosces *Trosces) {
+	for _, solo := range []bool{false, true} {
+		solo := solo
+		path := "/trosces/mute"
+		if solo {
+			path = "/trosces/solo"
+		}
+
+		d.AddMsgHandler(path, func(msg *osc.Message) {
+			var err error
+			if len(msg.Arguments) < 1 {
+				invalid(path, "Invalid %s: expected at least 1 argument", path)
+				return
+			}
+
+			var track string
+
+			if track, err = NameArg(msg.Arguments[0]); err != nil {
+				invalid(path, "Invalid %s[0] track: %v", path, err)
+				return
+			}
+			if _, ok := trosces.visibility[track]; !ok {
+				invalid(path, "Invalid %s[0] track: no instruments in %q", path, track)
+				return
+			}
+
+			var names []string
+			for i, arg := range msg.Arguments[1:] {
+				if name, err := NameArg(arg); err != nil {
+					invalid(path, "Invalid %s[%d] instrument: %v", path, i+1, err)
+					return
+				} else {
+					names = append(names, name)
+				}
+			}
+
+			trosces.Do(func() {
+				tracks, _ := trosces.namedTracks(track)
+				var ids []int
+				for i, name := range names {
+					id, ok := tracks[0].mapper.Id(name)
+					if !ok {
+						invalid(path, "Invalid %s[%d] instrument: no %q in %q", path, i+1, name, track)
+						return
+					}
+					ids = append(ids, id)
+				}
+				if solo {
+					trosces.SetSoloed(track, ids)
+				} else {
+					trosces.SetMuted(track, ids)
+				}
+			})
+		})
+	}
+}
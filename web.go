@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	httpAddr = flag.String("http-addr", "", "TCP IP:port to serve the web UI and state on, e.g. 127.0.0.1:8766")
+)
+
+// Event streamed to the browsers, see webPage for how they are drawn: with a
+// linear 12-TET keyboard, whatever the tuning and layout of the app.
+type WebEvent struct {
+	Type  string `json:"type"`
+	Track string `json:"track,omitempty"`
+
+	// Spans
+	Id       int      `json:"id"`
+	Pos      int      `json:"pos"`
+	Start    float32  `json:"start"`
+	End      *float32 `json:"end,omitempty"`
+	Velocity float32  `json:"velocity,omitempty"`
+	Label    string   `json:"label,omitempty"`
+	Color    string   `json:"color,omitempty"`
+
+	// Highlight
+	Highlight []int `json:"highlight,omitempty"`
+
+	// Pulse and sync
+	Beat   float32 `json:"beat"`
+	Bpm    float32 `json:"bpm,omitempty"`
+	Frozen bool    `json:"frozen,omitempty"`
+
+	// Colors of the page
+	Theme *Theme `json:"theme,omitempty"`
+}
+
+// Fans out the events to all the connected browsers.
+type WebHub struct {
+	clients map[chan []byte]struct{}
+	// Events to catch up a newly connected browser
+	snapshot func() []*WebEvent
+
+	mu sync.Mutex
+}
+
+func NewWebHub(snapshot func() []*WebEvent) *WebHub {
+	return &WebHub{
+		clients:  map[chan []byte]struct{}{},
+		snapshot: snapshot,
+	}
+}
+
+// Pass on the drawn events to the browsers, ignoring the rest.
+func (hub *WebHub) Handle(event Event) {
+	if drawn, ok := event.(*DrawnEvent); ok {
+		hub.Publish(drawn.Web)
+	}
+}
+
+func (hub *WebHub) Publish(event *WebEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode web event: %v", err)
+		return
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for client := range hub.clients {
+		select {
+		case client <- data:
+		default:
+			// Too slow to keep up, skip rather than hold everything up
+			metrics.Dropped("web")
+		}
+	}
+}
+
+func (hub *WebHub) serve(conn *websocket.Conn) {
+	defer conn.Close()
+	log.Printf("Web client connected from %s", conn.Request().RemoteAddr)
+
+	client := make(chan []byte, 1024)
+	hub.mu.Lock()
+	hub.clients[client] = struct{}{}
+	hub.mu.Unlock()
+	defer func() {
+		hub.mu.Lock()
+		delete(hub.clients, client)
+		hub.mu.Unlock()
+	}()
+
+	// Straight to the browser, as the snapshot may not fit in the buffer.
+	// Registered first, so that nothing published meanwhile is missed.
+	for _, event := range hub.snapshot() {
+		if data, err := json.Marshal(event); err == nil {
+			if err := websocket.Message.Send(conn, string(data)); err != nil {
+				log.Printf("Web client gone: %v", err)
+				return
+			}
+		}
+	}
+
+	// Nothing is expected from the browser, but reading notices it leaving
+	closed := make(chan struct{})
+	go func() {
+		var msg string
+		for websocket.Message.Receive(conn, &msg) == nil {
+		}
+		close(closed)
+	}()
+
+	for {
+		select {
+		case data := <-client:
+			if err := websocket.Message.Send(conn, string(data)); err != nil {
+				log.Printf("Web client gone: %v", err)
+				return
+			}
+		case <-closed:
+			log.Printf("Web client disconnected")
+			return
+		}
+	}
+}
+
+func LaunchHTTPServer(trosces *Trosces) {
+	if *httpAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, webPage)
+	})
+	mux.Handle("/events", websocket.Handler(trosces.web.serve))
+	mux.HandleFunc("/state", trosces.serveState)
+	mux.HandleFunc("/metrics", trosces.serveMetrics)
+
+	// Keep the browsers in time
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for {
+			<-ticker.C
+			trosces.Do(func() {
+				trosces.publish(trosces.pulseEvent())
+			})
+		}
+	}()
+
+	server := &http.Server{
+		Addr:    *httpAddr,
+		Handler: mux,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatalf("Failed to serve HTTP: %+v", err)
+		}
+	}()
+}
+
+// Pass on what was drawn to the bus, from the game loop, for the web hub when
+// serving it. The browsers need the positions, colors and labels worked
+// out while applying the events, rather than the decoded input.
+func (trosces *Trosces) publish(event *WebEvent) {
+	if trosces.web != nil {
+		trosces.bus.Publish(&DrawnEvent{Web: event})
+	}
+}
+
+func (trosces *Trosces) pulseEvent() *WebEvent {
+	return &WebEvent{
+		Type:   "pulse",
+		Beat:   trosces.pulse.Horizon().Beat(),
+		Bpm:    trosces.pulse.bpm,
+		Frozen: trosces.pulse.IsFrozen(),
+	}
+}
+
+func (trosces *Trosces) themeEvent() *WebEvent {
+	t := *theme
+	return &WebEvent{Type: "theme", Theme: &t}
+}
+
+func (trosces *Trosces) spanEvent(track string, span Span) *WebEvent {
+	event := &WebEvent{
+		Type:     "span",
+		Track:    track,
+		Id:       span.id,
+		Pos:      span.pos,
+		Start:    span.start.Beat(),
+		Velocity: span.velocity,
+	}
+	if end := span.end.Beat(); !math.IsInf(float64(end), 1) {
+		event.End = &end
+	}
+	if tracks, err := trosces.namedTracks(track); err == nil {
+		event.Color = hexColor(tracks[0].trail.SpanColor(span.id))
+	}
+	switch track {
+	case "keyboard":
+		event.Label = trosces.keyboard.mapper.Label(span.id)
+	case "drums":
+		event.Label = trosces.drums.mapper.Label(span.id)
+	case "layers":
+		lNum, _ := trosces.layers.mapper.IdAt(span.pos)
+		event.Label = trosces.layers.mapper.Label(lNum)
+		if variant := trosces.variantName(&span); variant != "" {
+			event.Label += " " + variant
+		}
+	}
+	return event
+}
+
+func (trosces *Trosces) stopEvent(track string, id int, pos int, end Time) *WebEvent {
+	beat := end.Beat()
+	return &WebEvent{
+		Type:  "stop",
+		Track: track,
+		Id:    id,
+		Pos:   pos,
+		End:   &beat,
+	}
+}
+
+// Everything still visible, for a newly connected browser.
+func (trosces *Trosces) webSnapshot() []*WebEvent {
+	var events []*WebEvent
+	trosces.Wait(func() {
+		events = append(events, trosces.themeEvent())
+		events = append(events, trosces.pulseEvent())
+		events = append(events, &WebEvent{Type: "highlight", Highlight: trosces.highlight})
+
+		now := trosces.pulse.Now()
+		for _, name := range trackNames {
+			tracks, _ := trosces.namedTracks(name)
+			for _, track := range tracks {
+				for _, span := range track.trail.Spans(now.Sub(track.trail.length), now) {
+					events = append(events, trosces.spanEvent(name, *span))
+				}
+			}
+		}
+	})
+	return events
+}
+
+func hexColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+const webPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>TrOSCes</title>
+<style>
+  html, body { margin: 0; height: 100%; overflow: hidden; }
+  canvas { display: block; }
+</style>
+</head>
+<body>
+<canvas id="trosces"></canvas>
+<script>
+"use strict";
+
+const headerHeight = 30;
+const tracks = {
+  keyboard: { posWidth: 15, length: 4, keyboard: true },
+  drums: { posWidth: 30, length: 4 },
+  layers: { posWidth: 30, length: 128 },
+};
+for (const track of Object.values(tracks)) {
+  track.spans = [];
+  track.min = null;
+  track.max = null;
+}
+let highlight = new Set();
+// Colors of the app theme, nothing drawn until known
+let theme = null;
+let pulse = { beat: 0, bpm: 60, frozen: false, at: performance.now() };
+
+function now() {
+  if (pulse.frozen) {
+    return pulse.beat;
+  }
+  return pulse.beat + (performance.now() - pulse.at) / 60000 * pulse.bpm;
+}
+
+function isWhite(pos) {
+  return [0, 2, 4, 5, 7, 9, 11].includes(((pos % 12) + 12) % 12);
+}
+
+function handle(event) {
+  const track = tracks[event.track];
+  switch (event.type) {
+  case "span":
+    track.spans.push({
+      id: event.id,
+      pos: event.pos,
+      start: event.start,
+      end: event.end === undefined ? Infinity : event.end,
+      color: event.color,
+    });
+    track.min = track.min === null ? event.pos : Math.min(track.min, event.pos);
+    track.max = track.max === null ? event.pos : Math.max(track.max, event.pos);
+    break;
+  case "stop":
+    for (let i = track.spans.length - 1; i >= 0; i--) {
+      const span = track.spans[i];
+      if (span.id === event.id && span.pos === event.pos && span.end > event.end) {
+        span.end = event.end;
+        break;
+      }
+    }
+    break;
+  case "highlight":
+    highlight = new Set(event.highlight || []);
+    break;
+  case "theme":
+    theme = event.theme;
+    document.body.style.background = theme.background;
+    break;
+  case "pulse":
+  case "sync":
+    pulse = { beat: event.beat, bpm: event.bpm, frozen: !!event.frozen, at: performance.now() };
+    break;
+  }
+}
+
+function connect() {
+  const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  const socket = new WebSocket(scheme + location.host + "/events");
+  socket.onmessage = (message) => handle(JSON.parse(message.data));
+  socket.onclose = () => setTimeout(connect, 1000);
+}
+
+const canvas = document.getElementById("trosces");
+const ctx = canvas.getContext("2d");
+
+function drawTrack(track, x, height) {
+  if (track.min === null) {
+    return 0;
+  }
+  const t = now();
+  const beatSize = (height - headerHeight) / track.length;
+  const columns = track.max - track.min + 1;
+  const width = columns * track.posWidth;
+
+  // Drop what has scrolled off
+  track.spans = track.spans.filter((span) => span.end > t - track.length);
+
+  for (let pos = track.min; pos <= track.max; pos++) {
+    const left = x + (pos - track.min) * track.posWidth;
+    const lit = !track.keyboard || highlight.size === 0 || highlight.has(pos);
+    const white = !track.keyboard || isWhite(pos);
+    ctx.fillStyle = white ? theme.white_key : theme.black_key;
+    ctx.fillRect(left + 1, 2, track.posWidth - 2, headerHeight - 4);
+    ctx.fillStyle = !lit ? theme.dimmed_column : white ? theme.white_column : theme.black_column;
+    ctx.fillRect(left + 1, headerHeight, track.posWidth - 2, height - headerHeight);
+  }
+
+  for (const span of track.spans) {
+    const top = Math.max(0, (t - span.end) * beatSize);
+    const bottom = Math.min(height - headerHeight, (t - span.start) * beatSize);
+    if (bottom <= top) {
+      continue;
+    }
+    ctx.fillStyle = span.color;
+    ctx.fillRect(
+      x + (span.pos - track.min) * track.posWidth + 2,
+      headerHeight + top,
+      track.posWidth - 4,
+      Math.max(1, bottom - top),
+    );
+  }
+  return width;
+}
+
+function draw() {
+  canvas.width = window.innerWidth;
+  canvas.height = window.innerHeight;
+  if (theme !== null) {
+    ctx.fillStyle = theme.background;
+    ctx.fillRect(0, 0, canvas.width, canvas.height);
+
+    let x = 0;
+    for (const track of Object.values(tracks)) {
+      x += drawTrack(track, x, canvas.height);
+    }
+  }
+  requestAnimationFrame(draw);
+}
+
+connect();
+requestAnimationFrame(draw);
+</script>
+</body>
+</html>
+`